@@ -1,30 +1,30 @@
 package main
 
 import (
-	"compress/gzip"
-	"context"
+	"bytes"
 	"encoding/binary"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/RoaringBitmap/roaring"
 	"github.com/dgraph-io/badger/v4"
 	"github.com/rs/zerolog/log"
 	"io"
 	"math"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 )
 
 type MediaCounts struct {
-	OwnedCount        uint16  `json:"ownedCount"`
-	AvailableCount    uint16  `json:"availableCount"`
-	HoldsCount        uint16  `json:"holdsCount"`
-	EstimatedWaitDays int16   `json:"estimatedWaitDays"`
-	Formats           []uint8 `json:"formats"`
+	OwnedCount        uint16 `json:"ownedCount"`
+	AvailableCount    uint16 `json:"availableCount"`
+	HoldsCount        uint16 `json:"holdsCount"`
+	EstimatedWaitDays int16  `json:"estimatedWaitDays"`
+	// the range of the estimated wait, they aren't stored
+	WaitDaysLow  int16   `json:"waitDaysLow"`
+	WaitDaysHigh int16   `json:"waitDaysHigh"`
+	Formats      []uint8 `json:"formats"`
 }
 
 type MediaCountResults struct {
@@ -32,13 +32,15 @@ type MediaCountResults struct {
 	AvailableCount    uint16   `json:"availableCount"`
 	HoldsCount        uint16   `json:"holdsCount"`
 	EstimatedWaitDays int16    `json:"estimatedWaitDays"`
+	WaitDaysLow       int16    `json:"waitDaysLow"`
+	WaitDaysHigh      int16    `json:"waitDaysHigh"`
 	Formats           []string `json:"formats"`
 }
 
-func NewMediaCountResults(mediaCounts *MediaCounts) MediaCountResults {
+func (g *generation) NewMediaCountResults(mediaCounts *MediaCounts) MediaCountResults {
 	var formats []string
 	for _, format := range mediaCounts.Formats {
-		formatInt, _ := formatReverseMap[format]
+		formatInt, _ := g.formatReverseMap[format]
 		formats = append(formats, formatInt)
 	}
 	return MediaCountResults{
@@ -46,6 +48,8 @@ func NewMediaCountResults(mediaCounts *MediaCounts) MediaCountResults {
 		AvailableCount:    mediaCounts.AvailableCount,
 		HoldsCount:        mediaCounts.HoldsCount,
 		EstimatedWaitDays: mediaCounts.EstimatedWaitDays,
+		WaitDaysLow:       mediaCounts.WaitDaysLow,
+		WaitDaysHigh:      mediaCounts.WaitDaysHigh,
 		Formats:           formats,
 	}
 }
@@ -53,6 +57,8 @@ func NewMediaCountResults(mediaCounts *MediaCounts) MediaCountResults {
 type LibraryMediaCounts struct {
 	Library Library `json:"library"`
 	MediaCountResults
+	// Sources is set when consortium holdings were merged into the counts
+	Sources []LibrarySource `json:"sources,omitempty"`
 }
 
 type AvailabilityResponse struct {
@@ -60,8 +66,11 @@ type AvailabilityResponse struct {
 	Availability []LibraryMediaCounts `json:"availability"`
 }
 
+// the total of the comparison responses is the size of the whole result, the
+// list only holds the page asked for with offset/limit
 type DiffResponse struct {
-	Diff []DiffMediaCounts `json:"diff"`
+	Total uint64            `json:"total"`
+	Diff  []DiffMediaCounts `json:"diff"`
 }
 
 type DiffMediaCounts struct {
@@ -71,15 +80,20 @@ type DiffMediaCounts struct {
 
 type UniqueResponse struct {
 	Library Library             `json:"library"`
+	Total   uint64              `json:"total"`
 	Unique  []UniqueMediaCounts `json:"unique"`
 }
 
 type UniqueMediaCounts struct {
 	*SearchResult
 	*MediaCounts
+	Sources []LibrarySource `json:"sources,omitempty"`
+	// library is only used for exports, the response has it once at the top
+	library *Library
 }
 
 type IntersectResponse struct {
+	Total     uint64                 `json:"total"`
 	Intersect []IntersectMediaCounts `json:"intersect"`
 }
 
@@ -89,239 +103,450 @@ type IntersectMediaCounts struct {
 	RightLibraryMediaCounts LibraryMediaCounts `json:"rightLibraryMediaCounts"`
 }
 
-var formatStringMap = map[string]uint8{}
-var formatReverseMap = map[uint8]string{}
-
-func readAvailability() {
-	if onDiskSize, _ := db.EstimateSize(nil); onDiskSize > 10000 {
+// readAvailability loads availability.csv.gz into the ma/la keys of g. when g
+// replaces a previous generation, or in incremental mode, the load is diffed
+// against the stored availability and the differences are kept in g.changes.
+// incremental mode only writes changed values and deletes pairs missing from the csv
+func (g *generation) readAvailability(previous *generation) error {
+	incremental := cfg.AvailabilityReloadMode == reloadModeIncremental
+	// formats are carried over and loaded first so format ids stay the same across loads
+	if previous != nil {
+		for format, formatInt := range previous.formatStringMap {
+			g.formatStringMap[format] = formatInt
+			g.formatReverseMap[formatInt] = format
+		}
+	}
+	err := g.readFormats()
+	if err != nil {
+		return fmt.Errorf("reading formats: %w", err)
+	}
+	if onDiskSize, _ := db.EstimateSize(g.key([]byte("la"))); onDiskSize > 10000 {
 		log.Info().Msg("availability already loaded")
-		db.View(func(txn *badger.Txn) error {
-			opts := badger.DefaultIteratorOptions
-			opts.Prefix = []byte("fmt")
-			iter := txn.NewIterator(opts)
-			defer iter.Close()
-			for iter.Rewind(); iter.ValidForPrefix([]byte("fmt")); iter.Next() {
-				item := iter.Item()
-				err := item.Value(func(val []byte) error {
-					formatStringMap[string(val)] = item.Key()[3]
-					formatReverseMap[item.Key()[3]] = string(val)
-					return nil
-				})
-				if err != nil {
-					return err
-				}
-			}
-			return nil
-		})
-		if os.Getenv("LOAD_ONLY") == "true" {
+		if incremental {
+			log.Info().Msg("incremental reload mode, diffing against stored availability")
+		} else if cfg.LoadOnly {
 			log.Info().Msg("load only mode, running load anyway")
 		} else {
-			return
+			return nil
 		}
 	}
 
-	var gzr *gzip.Reader
-	if os.Getenv("LOCAL_TESTING") == "true" {
-		f, err := os.Open("../../librarylibrary/availability.csv.gz")
-		defer f.Close()
-		if err != nil {
-			log.Error().Err(err)
-		}
-		gzr, err = gzip.NewReader(f)
-		if err != nil {
-			log.Error().Err(err)
-		}
-	} else {
-		s3Path := "availability.csv.gz"
-		if s3Client == nil {
-			getS3Client()
-		}
-		resp, err := s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-			Bucket: aws.String("deep-libby"),
-			Key:    aws.String(s3Path),
-		})
-		if err != nil {
-			log.Error().Err(err)
-		}
-		defer resp.Body.Close()
-		gzr, err = gzip.NewReader(resp.Body)
-		if err != nil {
-			log.Error().Err(err)
-		}
+	day, err := snapshotDay()
+	if err != nil {
+		return err
+	}
+	// new arrivals need an earlier load to have arrived since
+	previousSnapshots, err := getSnapshotDays()
+	if err != nil {
+		return fmt.Errorf("reading snapshots: %w", err)
+	}
+	cr, closer, err := openGzipCSV(dataSource, "availability.csv.gz")
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	report := newIngestReport("availability")
+	// base is what the load is diffed against, g itself when reloading in place
+	base := previous
+	if base == nil && incremental {
+		base = g
+	}
+	var changes *AvailabilityChangeSet
+	var seen map[uint16]*roaring.Bitmap
+	// reads go through a transaction started before any writes so the diff is
+	// against the previous load
+	var baseTxn *badger.Txn
+	if base != nil {
+		changes = NewAvailabilityChangeSet(dayToDate(day), g.libraryMap)
+		seen = map[uint16]*roaring.Bitmap{}
+		baseTxn = db.NewTransaction(false)
+		defer baseTxn.Discard()
 	}
-	cr := csv.NewReader(gzr)
 	writeBatch := db.NewWriteBatch()
 	count := 0
 	for {
-		record, err := cr.Read()
+		record, line, err := report.readRow(cr)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Error().Err(err)
-		}
-		id, err := strconv.ParseUint(record[0], 10, 32)
-		if err != nil {
-			log.Error().Err(err)
-		}
-		libraryId := record[1]
-		libraryIdInt, exists := libraryIdMap[libraryId]
-		if !exists {
-			panic("library id not found" + libraryId)
-		}
-		ownedCount, err := strconv.ParseUint(record[2], 10, 32)
-		if err != nil {
-			log.Error().Err(err)
-		}
-		availableCount, err := strconv.ParseUint(record[3], 10, 32)
-		if err != nil {
-			log.Error().Err(err)
-		}
-		holdsCount, err := strconv.ParseUint(record[4], 10, 16)
-		if err != nil {
-			log.Error().Err(err)
+			writeBatch.Cancel()
+			return fmt.Errorf("reading availability: %w", err)
 		}
-		estimatedWaitDays, err := strconv.ParseInt(record[5], 10, 32)
+		id, libraryIdInt, mediaCounts, err := g.parseAvailabilityRecord(record, writeBatch)
 		if err != nil {
-			log.Error().Err(err)
-		}
-		if availableCount > holdsCount {
-			estimatedWaitDays = 0
-		}
-		var formats []uint8
-		if record[6] != "" {
-			splitFormats := strings.Split(record[6], ";")
-			for _, format := range splitFormats {
-				formatInt, exists := formatStringMap[format]
-				if !exists {
-					formatInt = uint8(len(formatStringMap))
-					formatStringMap[format] = formatInt
-					formatReverseMap[formatInt] = format
-					err := writeBatch.Set(getFormatKey(formatInt), []byte(format))
-					if err != nil {
-						log.Err(err)
-					}
+			report.reject(line, err.Error(), record)
+			if base == nil {
+				continue
+			}
+			if id, libraryIdInt, err := g.parseAvailabilityIds(record); err == nil {
+				if err := g.keepQuarantinedAvailability(baseTxn, base, writeBatch, seen, id, libraryIdInt); err != nil {
+					writeBatch.Cancel()
+					return fmt.Errorf("keeping quarantined availability: %w", err)
 				}
-				formats = append(formats, formatInt)
 			}
+			continue
 		}
-		if ownedCount > math.MaxUint16 {
-			log.Warn().Msgf("owned count %d is greater than max uint16", ownedCount)
-			ownedCount = math.MaxUint16
-		}
-		if availableCount > math.MaxUint16 {
-			log.Warn().Msgf("available count %d is greater than max uint16", availableCount)
-			availableCount = math.MaxUint16
-		}
-		if holdsCount > math.MaxUint16 {
-			log.Warn().Msgf("holds count %d is greater than max uint16", holdsCount)
-			holdsCount = math.MaxUint16
-		}
-		if estimatedWaitDays > math.MaxInt16 {
-			log.Warn().Msgf("estimated wait days %d is greater than max int16", estimatedWaitDays)
-			estimatedWaitDays = math.MaxInt16
-		}
-		if estimatedWaitDays < math.MinInt16 {
-			log.Warn().Msgf("estimated wait days %d is less than min int16", estimatedWaitDays)
-			estimatedWaitDays = math.MinInt16
-		}
-		mediaCounts := &MediaCounts{
-			OwnedCount:        uint16(ownedCount),
-			AvailableCount:    uint16(availableCount),
-			HoldsCount:        uint16(holdsCount),
-			EstimatedWaitDays: int16(estimatedWaitDays),
-			Formats:           formats,
-		}
+		report.accept()
 		// pack ints into byte array
-		packedBytes := make([]byte, 8+len(formats))
-		binary.BigEndian.PutUint16(packedBytes[0:], mediaCounts.OwnedCount)
-		binary.BigEndian.PutUint16(packedBytes[2:], mediaCounts.AvailableCount)
-		binary.BigEndian.PutUint16(packedBytes[4:], mediaCounts.HoldsCount)
-		binary.BigEndian.PutUint16(packedBytes[6:], uint16(mediaCounts.EstimatedWaitDays))
-		maKey := getMediaAvailabilityKey(id, libraryIdInt)
-		laKey := getLibraryAvailabilityKey(libraryIdInt, id)
-		for i, format := range formats {
-			packedBytes[i+8] = format
-		}
+		packedBytes := encodeMediaCounts(mediaCounts)
+		maKey := g.getMediaAvailabilityKey(id, libraryIdInt)
+		laKey := g.getLibraryAvailabilityKey(libraryIdInt, id)
 		if id == 7349338 {
 			log.Debug().Msgf("writing to badger. key: %x, mediaCounts: %v", maKey, mediaCounts)
 			log.Debug().Msgf("writing to badger. key: %x, mediaCounts: %v", laKey, mediaCounts)
 		}
-		err = writeBatch.Set(maKey, packedBytes)
-		if err != nil {
-			log.Err(err)
+		write := true
+		// the history only gets the pairs that changed since the previous load
+		recordHistory := true
+		if base != nil {
+			libraryMedia, exists := seen[libraryIdInt]
+			if !exists {
+				libraryMedia = roaring.New()
+				seen[libraryIdInt] = libraryMedia
+			}
+			libraryMedia.Add(uint32(id))
+			baseLaKey := base.getLibraryAvailabilityKey(libraryIdInt, id)
+			changed, err := diffAvailability(baseTxn, baseLaKey, packedBytes, changes, libraryIdInt, uint32(id))
+			if err != nil {
+				writeBatch.Cancel()
+				return fmt.Errorf("reading previous availability: %w", err)
+			}
+			// a new generation starts out empty so it needs every value
+			write = changed || base != g
+			recordHistory = changed
 		}
-		err = writeBatch.Set(laKey, packedBytes)
-		if err != nil {
-			log.Err(err)
+		if write {
+			err = writeBatch.Set(maKey, packedBytes)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to write availability")
+			}
+			err = writeBatch.Set(laKey, packedBytes)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to write availability")
+			}
+		}
+		if recordHistory {
+			err = writeAvailabilityHistory(writeBatch, uint32(id), libraryIdInt, day, packedBytes)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to write availability history")
+			}
 		}
 		count++
 		if count%10000000 == 0 {
 			log.Info().Msgf("read %dM availability records", count/1000000)
 		}
 	}
-	err := writeBatch.Flush()
+	if base != nil {
+		err = base.removeUnseenAvailability(baseTxn, writeBatch, seen, changes, base == g)
+		if err != nil {
+			writeBatch.Cancel()
+			return fmt.Errorf("removing dropped availability: %w", err)
+		}
+		if err := writeRemovedHistory(writeBatch, changes, day); err != nil {
+			writeBatch.Cancel()
+			return fmt.Errorf("writing removed history: %w", err)
+		}
+	}
+	err = writeBatch.Flush()
 	if err != nil {
-		log.Err(err)
+		return fmt.Errorf("writing availability: %w", err)
+	}
+	if base != nil {
+		changes.LogSummary()
+		g.changes = changes
+		if len(previousSnapshots) > 0 {
+			if err := writeNewArrivals(changes, day); err != nil {
+				log.Error().Err(err).Msg("failed to record new arrivals")
+			}
+		}
 	}
-	gzr.Close()
 	// write format map into badger
-	for format, formatInt := range formatStringMap {
+	for format, formatInt := range g.formatStringMap {
 		err := db.Update(func(txn *badger.Txn) error {
-			err := txn.Set(getFormatKey(formatInt), []byte(format))
+			err := txn.Set(g.getFormatKey(formatInt), []byte(format))
 			if err != nil {
 				return err
 			}
 			return nil
 		})
 		if err != nil {
-			log.Err(err)
+			log.Error().Err(err).Msg("failed to write format")
 		}
 	}
-	log.Info().Msg("done reading availability")
+	err = writeSnapshot(day, count)
+	if err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	err = pruneAvailabilityHistory(day)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prune availability history")
+	}
+	days, err := getSnapshotDays()
+	if err != nil {
+		return fmt.Errorf("reading snapshots: %w", err)
+	}
+	g.historySnapshots = len(days)
+	if len(days) > 0 {
+		g.latestSnapshotDay = days[len(days)-1]
+	}
+	log.Info().Str("snapshot", dayToDate(day)).Msg("done reading availability")
+	return report.finish()
 }
 
-func getFormatKey(formatInt uint8) []byte {
+func (g *generation) readFormats() error {
+	prefix := g.key([]byte("fmt"))
+	return db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.ValidForPrefix(prefix); iter.Next() {
+			item := iter.Item()
+			formatInt := g.trimNamespace(item.Key())[3]
+			err := item.Value(func(val []byte) error {
+				g.formatStringMap[string(val)] = formatInt
+				g.formatReverseMap[formatInt] = string(val)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// diffAvailability compares the packed counts against the previous load, records
+// the difference in changes and reports whether the value was added or changed
+func diffAvailability(previous *badger.Txn, laKey []byte, packedBytes []byte, changes *AvailabilityChangeSet, libraryIdInt uint16, mediaId uint32) (bool, error) {
+	item, err := previous.Get(laKey)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		changes.Added(libraryIdInt, mediaId)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	unchanged := false
+	err = item.Value(func(val []byte) error {
+		unchanged = bytes.Equal(val, packedBytes)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if unchanged {
+		return false, nil
+	}
+	changes.Changed(libraryIdInt, mediaId)
+	return true, nil
+}
+
+// removeUnseenAvailability records every library/media pair of g that wasn't in
+// the csv as removed, and deletes its ma/la keys when deleteKeys is set
+func (g *generation) removeUnseenAvailability(txn *badger.Txn, writeBatch *badger.WriteBatch, seen map[uint16]*roaring.Bitmap, changes *AvailabilityChangeSet, deleteKeys bool) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = g.key([]byte("la"))
+	opts.PrefetchValues = false
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := g.trimNamespace(iter.Item().Key())
+		libraryIdInt := binary.BigEndian.Uint16(key[2:])
+		mediaId := binary.BigEndian.Uint32(key[4:])
+		if libraryMedia, exists := seen[libraryIdInt]; exists && libraryMedia.Contains(mediaId) {
+			continue
+		}
+		changes.Removed(libraryIdInt, mediaId)
+		if !deleteKeys {
+			continue
+		}
+		err := writeBatch.Delete(g.getLibraryAvailabilityKey(libraryIdInt, uint64(mediaId)))
+		if err != nil {
+			return err
+		}
+		err = writeBatch.Delete(g.getMediaAvailabilityKey(uint64(mediaId), libraryIdInt))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAvailabilityIds validates the media and library ids of an availability.csv row
+func (g *generation) parseAvailabilityIds(record []string) (uint64, uint16, error) {
+	if err := checkFieldCount(record, 7); err != nil {
+		return 0, 0, err
+	}
+	id, err := strconv.ParseUint(record[0], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid media id %q", record[0])
+	}
+	libraryIdInt, exists := g.libraryIdMap[record[1]]
+	if !exists {
+		return 0, 0, fmt.Errorf("library id not found %q", record[1])
+	}
+	return id, libraryIdInt, nil
+}
+
+// keepQuarantinedAvailability keeps the previous counts of a pair whose row
+// was rejected, so a bad line doesn't remove the title from the library. the
+// pair is marked seen and, when loading into a new generation, copied over
+func (g *generation) keepQuarantinedAvailability(baseTxn *badger.Txn, base *generation, writeBatch *badger.WriteBatch, seen map[uint16]*roaring.Bitmap, id uint64, libraryIdInt uint16) error {
+	libraryMedia, exists := seen[libraryIdInt]
+	if !exists {
+		libraryMedia = roaring.New()
+		seen[libraryIdInt] = libraryMedia
+	}
+	libraryMedia.Add(uint32(id))
+	if base == g {
+		return nil
+	}
+	item, err := baseTxn.Get(base.getLibraryAvailabilityKey(libraryIdInt, id))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	packedBytes, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if err := writeBatch.Set(g.getMediaAvailabilityKey(id, libraryIdInt), packedBytes); err != nil {
+		return err
+	}
+	return writeBatch.Set(g.getLibraryAvailabilityKey(libraryIdInt, id), packedBytes)
+}
+
+// parseAvailabilityRecord validates an availability.csv row:
+// mediaId, libraryId, ownedCount, availableCount, holdsCount, estimatedWaitDays, formats
+// new formats are registered in g.formatStringMap and written to the batch
+func (g *generation) parseAvailabilityRecord(record []string, writeBatch *badger.WriteBatch) (uint64, uint16, *MediaCounts, error) {
+	id, libraryIdInt, err := g.parseAvailabilityIds(record)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	ownedCount, err := strconv.ParseUint(record[2], 10, 32)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("invalid ownedCount %q", record[2])
+	}
+	availableCount, err := strconv.ParseUint(record[3], 10, 32)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("invalid availableCount %q", record[3])
+	}
+	holdsCount, err := strconv.ParseUint(record[4], 10, 32)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("invalid holdsCount %q", record[4])
+	}
+	estimatedWaitDays, err := strconv.ParseInt(record[5], 10, 32)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("invalid estimatedWaitDays %q", record[5])
+	}
+	if availableCount > holdsCount {
+		estimatedWaitDays = 0
+	}
+	var formats []uint8
+	if record[6] != "" {
+		splitFormats := strings.Split(record[6], ";")
+		for _, format := range splitFormats {
+			formatInt, exists := g.formatStringMap[format]
+			if !exists {
+				if len(g.formatStringMap) > math.MaxUint8 {
+					return 0, 0, nil, fmt.Errorf("too many formats, can't add %q", format)
+				}
+				formatInt = uint8(len(g.formatStringMap))
+				g.formatStringMap[format] = formatInt
+				g.formatReverseMap[formatInt] = format
+				err := writeBatch.Set(g.getFormatKey(formatInt), []byte(format))
+				if err != nil {
+					log.Error().Err(err).Msg("failed to write format")
+				}
+			}
+			formats = append(formats, formatInt)
+		}
+	}
+	if ownedCount > math.MaxUint16 {
+		log.Warn().Msgf("owned count %d is greater than max uint16", ownedCount)
+		ownedCount = math.MaxUint16
+	}
+	if availableCount > math.MaxUint16 {
+		log.Warn().Msgf("available count %d is greater than max uint16", availableCount)
+		availableCount = math.MaxUint16
+	}
+	if holdsCount > math.MaxUint16 {
+		log.Warn().Msgf("holds count %d is greater than max uint16", holdsCount)
+		holdsCount = math.MaxUint16
+	}
+	if estimatedWaitDays > math.MaxInt16 {
+		log.Warn().Msgf("estimated wait days %d is greater than max int16", estimatedWaitDays)
+		estimatedWaitDays = math.MaxInt16
+	}
+	if estimatedWaitDays < math.MinInt16 {
+		log.Warn().Msgf("estimated wait days %d is less than min int16", estimatedWaitDays)
+		estimatedWaitDays = math.MinInt16
+	}
+	return id, libraryIdInt, &MediaCounts{
+		OwnedCount:        uint16(ownedCount),
+		AvailableCount:    uint16(availableCount),
+		HoldsCount:        uint16(holdsCount),
+		EstimatedWaitDays: int16(estimatedWaitDays),
+		Formats:           formats,
+	}, nil
+}
+
+func encodeMediaCounts(mediaCounts *MediaCounts) []byte {
+	packedBytes := make([]byte, 8+len(mediaCounts.Formats))
+	binary.BigEndian.PutUint16(packedBytes[0:], mediaCounts.OwnedCount)
+	binary.BigEndian.PutUint16(packedBytes[2:], mediaCounts.AvailableCount)
+	binary.BigEndian.PutUint16(packedBytes[4:], mediaCounts.HoldsCount)
+	binary.BigEndian.PutUint16(packedBytes[6:], uint16(mediaCounts.EstimatedWaitDays))
+	copy(packedBytes[8:], mediaCounts.Formats)
+	return packedBytes
+}
+
+func (g *generation) getFormatKey(formatInt uint8) []byte {
 	formatKey := make([]byte, 4)
 	formatKey[0] = 'f'
 	formatKey[1] = 'm'
 	formatKey[2] = 't'
 	formatKey[3] = formatInt
-	return formatKey
+	return g.key(formatKey)
 }
 
-func getMediaAvailabilityKey(id uint64, libraryIdInt uint16) []byte {
+func (g *generation) getMediaAvailabilityKey(id uint64, libraryIdInt uint16) []byte {
 	mediaAvailabilityKey := make([]byte, 8)
 	mediaAvailabilityKey[0] = 'm'
 	mediaAvailabilityKey[1] = 'a'
 	binary.BigEndian.PutUint32(mediaAvailabilityKey[2:], uint32(id))
 	binary.BigEndian.PutUint16(mediaAvailabilityKey[6:], libraryIdInt)
-	return mediaAvailabilityKey
+	return g.key(mediaAvailabilityKey)
 }
 
-func getLibraryAvailabilityKey(libraryIdInt uint16, id uint64) []byte {
+func (g *generation) getLibraryAvailabilityKey(libraryIdInt uint16, id uint64) []byte {
 	libraryAvailabilityKey := make([]byte, 8)
 	libraryAvailabilityKey[0] = 'l'
 	libraryAvailabilityKey[1] = 'a'
 	binary.BigEndian.PutUint16(libraryAvailabilityKey[2:], libraryIdInt)
 	binary.BigEndian.PutUint32(libraryAvailabilityKey[4:], uint32(id))
-	return libraryAvailabilityKey
+	return g.key(libraryAvailabilityKey)
 }
 
-func getMediaAvailabilityPrefix(mediaId uint32) []byte {
+func (g *generation) getMediaAvailabilityPrefix(mediaId uint32) []byte {
 	prefix := make([]byte, 6)
 	prefix[0] = 'm'
 	prefix[1] = 'a'
 	binary.BigEndian.PutUint32(prefix[2:], mediaId)
-	return prefix
+	return g.key(prefix)
 }
 
-func getLibraryAvailabilityPrefix(libraryId uint16) []byte {
+func (g *generation) getLibraryAvailabilityPrefix(libraryId uint16) []byte {
 	prefix := make([]byte, 4)
 	prefix[0] = 'l'
 	prefix[1] = 'a'
 	binary.BigEndian.PutUint16(prefix[2:], libraryId)
-	return prefix
+	return g.key(prefix)
 }
 
 func decodeMediaCounts(data []byte) (*MediaCounts, error) {
@@ -339,60 +564,45 @@ func decodeMediaCounts(data []byte) (*MediaCounts, error) {
 }
 
 func availabilityHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
 	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 32)
 	if err != nil {
 		http.Error(w, "invalid id", http.StatusBadRequest)
 		return
 	}
+	format, err := parseExportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	withConsortium := includeConsortium(r)
 	var availability AvailabilityResponse
-	var results []LibraryMediaCounts
 	err = db.View(func(txn *badger.Txn) error {
-		media, err := getMedia(uint32(id))
+		media, err := g.getMediaTxn(txn, uint32(id))
 		if err != nil {
 			return err
 		}
-		log.Info().Msgf("/api/availability media: %v", NewSearchResult(media))
-		prefix := getMediaAvailabilityPrefix(uint32(id))
-		log.Info().Msgf("availability using prefix: %x", prefix)
-		opt := badger.DefaultIteratorOptions
-		opt.Prefix = prefix
-		iter := txn.NewIterator(opt)
-		defer iter.Close()
-		for iter.Rewind(); iter.ValidForPrefix(prefix); iter.Next() {
-			item := iter.Item()
-			err := item.Value(func(val []byte) error {
-				log.Trace().Msgf("found item with key: %x and val: %x", item.Key(), val)
-				availabilityBytes := val
-				libraryId := binary.BigEndian.Uint16(item.Key()[6:])
-				counts, err := decodeMediaCounts(availabilityBytes)
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to decode media counts")
-					return nil
-				}
-				library, exists := libraryMap[libraryId]
-				if !exists {
-					log.Error().Msgf("library not found for library id %d", libraryId)
-					return nil
-				}
-				if library.Id == "uskindle" {
-					return nil
-				}
-				results = append(results, LibraryMediaCounts{
-					Library:           library,
-					MediaCountResults: NewMediaCountResults(counts),
-				})
-				return nil
-			})
-			if err != nil {
-				return err
-			}
-		}
+		log.Info().Msgf("/api/availability media: %v", g.NewSearchResult(media))
 		availability = AvailabilityResponse{
-			SearchResult: NewSearchResult(media),
-			Availability: results,
+			SearchResult: g.NewSearchResult(media),
+			Availability: g.getMediaAvailability(txn, uint32(id), withConsortium),
 		}
 		return nil
 	})
+	if format != "" {
+		if availability.SearchResult == nil {
+			http.Error(w, "media not found", http.StatusNotFound)
+			return
+		}
+		table, err := newTableWriter(w, format, fmt.Sprintf("availability-%d", id))
+		if err == nil {
+			err = writeExportRows(table, availability.exportRows(g))
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to write availability export")
+		}
+		return
+	}
 	w.Header().Add("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(availability)
 	if err != nil {
@@ -400,288 +610,271 @@ func availabilityHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// getMediaAvailability reads the counts of a media at every visible library
+// owning it, and at the members of its consortia when withConsortium is set
+func (g *generation) getMediaAvailability(txn *badger.Txn, mediaId uint32, withConsortium bool) []LibraryMediaCounts {
+	prefix := g.getMediaAvailabilityPrefix(mediaId)
+	log.Debug().Msgf("availability using prefix: %x", prefix)
+	var libraryIds []uint16
+	opt := badger.DefaultIteratorOptions
+	opt.Prefix = prefix
+	opt.PrefetchValues = false
+	iter := txn.NewIterator(opt)
+	for iter.Rewind(); iter.ValidForPrefix(prefix); iter.Next() {
+		libraryIds = append(libraryIds, binary.BigEndian.Uint16(g.trimNamespace(iter.Item().Key())[6:]))
+	}
+	iter.Close()
+	// members of a consortium that owns the title can borrow it without owning it
+	if withConsortium {
+		listed := map[uint16]bool{}
+		for _, libraryId := range libraryIds {
+			listed[libraryId] = true
+		}
+		for _, libraryId := range libraryIds {
+			for _, memberId := range g.consortiumMembers[libraryId] {
+				if !listed[memberId] {
+					listed[memberId] = true
+					libraryIds = append(libraryIds, memberId)
+				}
+			}
+		}
+	}
+	results := []LibraryMediaCounts{}
+	for _, libraryId := range libraryIds {
+		// hidden by the library rules
+		library, exists := g.library(libraryId)
+		if !exists {
+			continue
+		}
+		counts, sources, err := g.getMergedMediaCounts(txn, libraryId, mediaId, withConsortium)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read media counts")
+			continue
+		}
+		results = append(results, LibraryMediaCounts{
+			Library:           library,
+			MediaCountResults: g.NewMediaCountResults(counts),
+			Sources:           sources,
+		})
+	}
+	return results
+}
+
+// lookupLibrary resolves a library id from a request to its int id, hidden libraries aren't found
+func (g *generation) lookupLibrary(libraryId string) (uint16, Library, bool) {
+	libraryIdInt, exists := g.libraryIdMap[libraryId]
+	if !exists {
+		return 0, Library{}, false
+	}
+	library, exists := g.library(libraryIdInt)
+	return libraryIdInt, library, exists
+}
+
+// diffBitmap is what left owns and right doesn't
+func (g *generation) diffBitmap(leftLibraryIdInt, rightLibraryIdInt uint16, withConsortium bool) *roaring.Bitmap {
+	return roaring.AndNot(g.effectiveBitmap(leftLibraryIdInt, withConsortium), g.effectiveBitmap(rightLibraryIdInt, withConsortium))
+}
+
+func (g *generation) intersectBitmap(leftLibraryIdInt, rightLibraryIdInt uint16) *roaring.Bitmap {
+	return roaring.And(g.libraryBitmap(leftLibraryIdInt), g.libraryBitmap(rightLibraryIdInt))
+}
+
+// libraryUniqueBitmap is what only the library (or, with its consortia, only the group) owns
+func (g *generation) libraryUniqueBitmap(libraryIdInt uint16, withConsortium bool) *roaring.Bitmap {
+	if withConsortium && len(g.consortia[libraryIdInt]) > 0 {
+		return g.uniqueWithConsortia(libraryIdInt)
+	}
+	return roaring.And(g.libraryBitmap(libraryIdInt), g.visibility().unique)
+}
+
 func diffHandler(w http.ResponseWriter, r *http.Request) {
-	leftLibraryId := r.URL.Query().Get("leftLibraryId")
-	rightLibraryId := r.URL.Query().Get("rightLibraryId")
-	leftLibraryIdInt := libraryIdMap[leftLibraryId]
-	rightLibraryIdInt := libraryIdMap[rightLibraryId]
-	leftLibrary, leftExists := libraryMap[leftLibraryIdInt]
-	rightLibrary, rightExists := libraryMap[rightLibraryIdInt]
+	g := requestGeneration(r)
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := parseExportFormat(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	leftLibraryIdInt, leftLibrary, leftExists := g.lookupLibrary(r.URL.Query().Get("leftLibraryId"))
+	rightLibraryIdInt, rightLibrary, rightExists := g.lookupLibrary(r.URL.Query().Get("rightLibraryId"))
 	if !leftExists || !rightExists {
 		http.Error(w, "invalid library id", http.StatusBadRequest)
 		return
 	}
 	log.Info().Msgf("/api/diff left: %s right: %s", leftLibrary.Id, rightLibrary.Id)
-
-	leftCounts := map[uint32]*MediaCounts{}
-	err := db.View(func(txn *badger.Txn) error {
-		prefix := getLibraryAvailabilityPrefix(leftLibraryIdInt)
-		opt := badger.DefaultIteratorOptions
-		opt.Prefix = prefix
-		iter := txn.NewIterator(opt)
-		defer iter.Close()
-		for iter.Rewind(); iter.Valid(); iter.Next() {
-			item := iter.Item()
-			err := item.Value(func(val []byte) error {
-				availabilityBytes := val
-				mediaId := binary.BigEndian.Uint32(item.Key()[4:])
-				counts := &MediaCounts{
-					OwnedCount:        binary.BigEndian.Uint16(availabilityBytes[0:2]),
-					AvailableCount:    binary.BigEndian.Uint16(availabilityBytes[2:4]),
-					HoldsCount:        binary.BigEndian.Uint16(availabilityBytes[4:6]),
-					EstimatedWaitDays: int16(binary.BigEndian.Uint16(availabilityBytes[6:8])),
-					Formats:           availabilityBytes[8:],
-				}
-				leftCounts[mediaId] = counts
-				return nil
-			})
+	withConsortium := includeConsortium(r)
+	bitmap := g.diffBitmap(leftLibraryIdInt, rightLibraryIdInt, withConsortium)
+	diff := newRecordWriter[DiffMediaCounts](w, r, bitmap.GetCardinality(), "diff-"+leftLibrary.Id+"-"+rightLibrary.Id)
+	err = db.View(func(txn *badger.Txn) error {
+		for _, id := range page.ids(bitmap) {
+			counts, sources, err := g.getMergedMediaCounts(txn, leftLibraryIdInt, id, withConsortium)
 			if err != nil {
 				return err
 			}
-		}
-		return nil
-	})
-	if err != nil {
-		log.Err(err)
-	}
-	rightCounts := map[uint32]*MediaCounts{}
-	err = db.View(func(txn *badger.Txn) error {
-		prefix := getLibraryAvailabilityPrefix(rightLibraryIdInt)
-		iter := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer iter.Close()
-		for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
-			item := iter.Item()
-			err := item.Value(func(val []byte) error {
-				availabilityBytes := val
-				mediaId := binary.BigEndian.Uint32(item.Key()[4:])
-				counts := &MediaCounts{
-					OwnedCount:        binary.BigEndian.Uint16(availabilityBytes[0:2]),
-					AvailableCount:    binary.BigEndian.Uint16(availabilityBytes[2:4]),
-					HoldsCount:        binary.BigEndian.Uint16(availabilityBytes[4:6]),
-					EstimatedWaitDays: int16(binary.BigEndian.Uint16(availabilityBytes[6:8])),
-					Formats:           availabilityBytes[8:],
-				}
-				rightCounts[mediaId] = counts
-				return nil
-			})
+			media, err := g.getMedia(id)
 			if err != nil {
 				return err
 			}
-		}
-		return nil
-	})
-	if err != nil {
-		log.Err(err)
-	}
-	log.Info().Msgf("diff, left: %d, right: %d", len(leftCounts), len(rightCounts))
-	diff := []DiffMediaCounts{}
-	for id, leftCount := range leftCounts {
-		_, exists := rightCounts[id]
-		if !exists {
-			mediaRecord, _ := getMedia(id)
-			diff = append(diff, DiffMediaCounts{
-				SearchResult: NewSearchResult(mediaRecord),
+			err = diff.Write(DiffMediaCounts{
+				SearchResult: g.NewSearchResult(media),
 				LibraryMediaCounts: LibraryMediaCounts{
 					Library:           leftLibrary,
-					MediaCountResults: NewMediaCountResults(leftCount),
+					MediaCountResults: g.NewMediaCountResults(counts),
+					Sources:           sources,
 				},
 			})
+			if err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		diff.Fail(err, "failed to read diff")
+		return
 	}
-	if len(diff) == 0 {
-		diff = []DiffMediaCounts{}
-	}
-	log.Info().Msg("hash diff complete")
-	diffResponse := DiffResponse{
-		Diff: diff,
+	log.Info().Uint64("total", bitmap.GetCardinality()).Bool("streamed", diff.Streaming()).Msg("bitmap diff complete")
+	if diff.Streaming() {
+		return
 	}
-	// TODO paginate this
 	w.Header().Add("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(diffResponse)
+	err = json.NewEncoder(w).Encode(DiffResponse{
+		Total: bitmap.GetCardinality(),
+		Diff:  diff.records,
+	})
 	if err != nil {
 		log.Error().Err(err)
 	}
 }
 
 func intersectHandler(w http.ResponseWriter, r *http.Request) {
-	leftLibraryId := r.URL.Query().Get("leftLibraryId")
-	rightLibraryId := r.URL.Query().Get("rightLibraryId")
-	leftLibraryIdInt := libraryIdMap[leftLibraryId]
-	rightLibraryIdInt := libraryIdMap[rightLibraryId]
-	leftLibrary, leftExists := libraryMap[leftLibraryIdInt]
-	rightLibrary, rightExists := libraryMap[rightLibraryIdInt]
+	g := requestGeneration(r)
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := parseExportFormat(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	leftLibraryIdInt, leftLibrary, leftExists := g.lookupLibrary(r.URL.Query().Get("leftLibraryId"))
+	rightLibraryIdInt, rightLibrary, rightExists := g.lookupLibrary(r.URL.Query().Get("rightLibraryId"))
 	if !leftExists || !rightExists {
 		http.Error(w, "invalid library id", http.StatusBadRequest)
 		return
 	}
 	log.Info().Msgf("/api/intersect left: %s right: %s", leftLibrary.Id, rightLibrary.Id)
-	leftMedia := map[uint32]*MediaCounts{}
-	err := db.View(func(txn *badger.Txn) error {
-		prefix := getLibraryAvailabilityPrefix(leftLibraryIdInt)
-		opt := badger.DefaultIteratorOptions
-		opt.Prefix = prefix
-		iter := txn.NewIterator(opt)
-		defer iter.Close()
-		for iter.Rewind(); iter.Valid(); iter.Next() {
-			item := iter.Item()
-			err := item.Value(func(val []byte) error {
-				availabilityBytes := val
-				mediaId := binary.BigEndian.Uint32(item.Key()[4:])
-				counts := &MediaCounts{
-					OwnedCount:        binary.BigEndian.Uint16(availabilityBytes[0:2]),
-					AvailableCount:    binary.BigEndian.Uint16(availabilityBytes[2:4]),
-					HoldsCount:        binary.BigEndian.Uint16(availabilityBytes[4:6]),
-					EstimatedWaitDays: int16(binary.BigEndian.Uint16(availabilityBytes[6:8])),
-					Formats:           availabilityBytes[8:],
-				}
-				leftMedia[mediaId] = counts
-				return nil
-			})
+	bitmap := g.intersectBitmap(leftLibraryIdInt, rightLibraryIdInt)
+	intersect := newRecordWriter[IntersectMediaCounts](w, r, bitmap.GetCardinality(), "intersect-"+leftLibrary.Id+"-"+rightLibrary.Id)
+	err = db.View(func(txn *badger.Txn) error {
+		for _, id := range page.ids(bitmap) {
+			leftCounts, err := g.getLibraryMediaCounts(txn, leftLibraryIdInt, id)
 			if err != nil {
 				return err
 			}
-		}
-		return nil
-	})
-	if err != nil {
-		log.Err(err)
-	}
-	rightMedia := map[uint32]*MediaCounts{}
-	err = db.View(func(txn *badger.Txn) error {
-		prefix := getLibraryAvailabilityPrefix(rightLibraryIdInt)
-		opt := badger.DefaultIteratorOptions
-		opt.Prefix = prefix
-		iter := txn.NewIterator(opt)
-		defer iter.Close()
-		for iter.Rewind(); iter.Valid(); iter.Next() {
-			item := iter.Item()
-			err := item.Value(func(val []byte) error {
-				availabilityBytes := val
-				mediaId := binary.BigEndian.Uint32(item.Key()[4:])
-				counts := &MediaCounts{
-					OwnedCount:        binary.BigEndian.Uint16(availabilityBytes[0:2]),
-					AvailableCount:    binary.BigEndian.Uint16(availabilityBytes[2:4]),
-					HoldsCount:        binary.BigEndian.Uint16(availabilityBytes[4:6]),
-					EstimatedWaitDays: int16(binary.BigEndian.Uint16(availabilityBytes[6:8])),
-					Formats:           availabilityBytes[8:],
-				}
-				rightMedia[mediaId] = counts
-				return nil
-			})
+			rightCounts, err := g.getLibraryMediaCounts(txn, rightLibraryIdInt, id)
 			if err != nil {
 				return err
 			}
-		}
-		return nil
-	})
-	if err != nil {
-		log.Err(err)
-	}
-	log.Info().Msgf("intersect, left: %d, right: %d", len(leftMedia), len(rightMedia))
-	var intersect []IntersectMediaCounts
-	for id, leftCount := range leftMedia {
-		rightCount, exists := rightMedia[id]
-		if exists {
-			media, _ := getMedia(id)
-			intersect = append(intersect, IntersectMediaCounts{
-				SearchResult: NewSearchResult(media),
+			media, err := g.getMedia(id)
+			if err != nil {
+				return err
+			}
+			err = intersect.Write(IntersectMediaCounts{
+				SearchResult: g.NewSearchResult(media),
 				LeftLibraryMediaCounts: LibraryMediaCounts{
-					leftLibrary,
-					NewMediaCountResults(leftCount),
+					Library:           leftLibrary,
+					MediaCountResults: g.NewMediaCountResults(leftCounts),
 				},
 				RightLibraryMediaCounts: LibraryMediaCounts{
-					rightLibrary,
-					NewMediaCountResults(rightCount),
+					Library:           rightLibrary,
+					MediaCountResults: g.NewMediaCountResults(rightCounts),
 				},
 			})
+			if err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		intersect.Fail(err, "failed to read intersect")
+		return
 	}
-	log.Info().Msg("hash intersect complete")
-	if len(intersect) == 0 {
-		intersect = []IntersectMediaCounts{}
-	}
-	diffResponse := IntersectResponse{
-		Intersect: intersect,
+	log.Info().Uint64("total", bitmap.GetCardinality()).Bool("streamed", intersect.Streaming()).Msg("bitmap intersect complete")
+	if intersect.Streaming() {
+		return
 	}
-	// TODO paginate this
 	w.Header().Add("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(diffResponse)
+	err = json.NewEncoder(w).Encode(IntersectResponse{
+		Total:     bitmap.GetCardinality(),
+		Intersect: intersect.records,
+	})
 	if err != nil {
 		log.Error().Err(err)
 	}
 }
 
 func uniqueHandler(w http.ResponseWriter, r *http.Request) {
-	libraryId := r.URL.Query().Get("libraryId")
-	libraryIdInt, exists := libraryIdMap[libraryId]
-	if !exists {
-		panic("library id not found" + libraryId)
+	g := requestGeneration(r)
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := parseExportFormat(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	library, libraryExists := libraryMap[libraryIdInt]
-	if !libraryExists {
+	libraryIdInt, library, exists := g.lookupLibrary(r.URL.Query().Get("libraryId"))
+	if !exists {
 		http.Error(w, "invalid library id", http.StatusBadRequest)
 		return
 	}
 	log.Info().Msgf("/api/unique libraryId %s", library.Id)
-	var unique []UniqueMediaCounts
-	media := map[uint32]*MediaCounts{}
-	db.View(func(txn *badger.Txn) error {
-		prefix := getLibraryAvailabilityPrefix(libraryIdInt)
-		opt := badger.DefaultIteratorOptions
-		opt.Prefix = prefix
-		iter := txn.NewIterator(opt)
-		defer iter.Close()
-		for iter.Rewind(); iter.Valid(); iter.Next() {
-			mediaId := binary.BigEndian.Uint32(iter.Item().Key()[4:])
-			item := iter.Item()
-			err := item.Value(func(val []byte) error {
-				availabilityBytes := val
-				counts := &MediaCounts{
-					OwnedCount:        binary.BigEndian.Uint16(availabilityBytes[0:2]),
-					AvailableCount:    binary.BigEndian.Uint16(availabilityBytes[2:4]),
-					HoldsCount:        binary.BigEndian.Uint16(availabilityBytes[4:6]),
-					EstimatedWaitDays: int16(binary.BigEndian.Uint16(availabilityBytes[6:8])),
-					Formats:           availabilityBytes[8:],
-				}
-				media[mediaId] = counts
-				return nil
-			})
+	withConsortium := includeConsortium(r)
+	bitmap := g.libraryUniqueBitmap(libraryIdInt, withConsortium)
+	unique := newRecordWriter[UniqueMediaCounts](w, r, bitmap.GetCardinality(), "unique-"+library.Id)
+	err = db.View(func(txn *badger.Txn) error {
+		for _, id := range page.ids(bitmap) {
+			counts, sources, err := g.getMergedMediaCounts(txn, libraryIdInt, id, withConsortium)
 			if err != nil {
 				return err
 			}
-		}
-		log.Info().Msg("starting unique search")
-		for mediaId, count := range media {
-			mediaPrefix := getMediaAvailabilityPrefix(mediaId)
-			opt := badger.DefaultIteratorOptions
-			opt.Prefix = mediaPrefix
-			iter := txn.NewIterator(opt)
-			defer iter.Close()
-			countIterations := 0
-			for iter.Rewind(); iter.Valid(); iter.Next() {
-				countIterations++
+			media, err := g.getMedia(id)
+			if err != nil {
+				return err
 			}
-			if countIterations == 1 {
-				mediaRecord, _ := getMedia(mediaId)
-				unique = append(unique, UniqueMediaCounts{
-					SearchResult: NewSearchResult(mediaRecord),
-					MediaCounts:  count,
-				})
+			err = unique.Write(UniqueMediaCounts{
+				SearchResult: g.NewSearchResult(media),
+				MediaCounts:  counts,
+				Sources:      sources,
+				library:      &library,
+			})
+			if err != nil {
+				return err
 			}
 		}
 		return nil
 	})
-	if len(unique) == 0 {
-		unique = []UniqueMediaCounts{}
+	if err != nil {
+		unique.Fail(err, "failed to read unique")
+		return
 	}
-	log.Info().Msg("returning unique response")
-	diffResponse := UniqueResponse{
-		Library: library,
-		Unique:  unique,
+	log.Info().Uint64("total", bitmap.GetCardinality()).Bool("streamed", unique.Streaming()).Msg("returning unique response")
+	if unique.Streaming() {
+		return
 	}
-	// TODO paginate this
 	w.Header().Add("Content-Type", "application/json")
-	err := json.NewEncoder(w).Encode(diffResponse)
+	err = json.NewEncoder(w).Encode(UniqueResponse{
+		Library: library,
+		Total:   bitmap.GetCardinality(),
+		Unique:  unique.records,
+	})
 	if err != nil {
 		log.Error().Err(err)
 	}
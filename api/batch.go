@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sort"
+)
+
+// maxBatchRequestBytes bounds the body of a batch request, ids are small
+const maxBatchRequestBytes = 1 << 20
+
+type BatchAvailabilityRequest struct {
+	Ids []uint32 `json:"ids"`
+	// LibraryIds restricts the availability to these libraries, every visible library when empty
+	LibraryIds        []string `json:"libraryIds"`
+	IncludeConsortium bool     `json:"includeConsortium"`
+}
+
+type BatchAvailabilityResponse struct {
+	Results []AvailabilityResponse `json:"results"`
+	// NotFound lists the requested ids without media
+	NotFound  []uint32             `json:"notFound"`
+	Libraries []BatchLibraryRollup `json:"libraries"`
+}
+
+// BatchLibraryRollup counts how many of the requested titles a library has
+type BatchLibraryRollup struct {
+	Library      Library `json:"library"`
+	Owned        int     `json:"owned"`
+	AvailableNow int     `json:"availableNow"`
+}
+
+func batchAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	var request BatchAvailabilityRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "invalid batch request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.Ids) == 0 {
+		http.Error(w, "ids is required", http.StatusBadRequest)
+		return
+	}
+	if len(request.Ids) > cfg.MaxBatchSize {
+		http.Error(w, fmt.Sprintf("at most %d ids can be requested", cfg.MaxBatchSize), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseLibraryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var libraries map[string]bool
+	for _, libraryId := range request.LibraryIds {
+		if _, _, exists := g.lookupLibrary(libraryId); !exists {
+			http.Error(w, "invalid library id "+libraryId, http.StatusBadRequest)
+			return
+		}
+		if libraries == nil {
+			libraries = map[string]bool{}
+		}
+		libraries[libraryId] = true
+	}
+	log.Info().Msgf("/api/availability/batch ids: %d libraries: %d", len(request.Ids), len(request.LibraryIds))
+	response := BatchAvailabilityResponse{
+		Results:   []AvailabilityResponse{},
+		NotFound:  []uint32{},
+		Libraries: []BatchLibraryRollup{},
+	}
+	rollups := map[string]*BatchLibraryRollup{}
+	seen := map[uint32]bool{}
+	err = db.View(func(txn *badger.Txn) error {
+		for _, id := range request.Ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			media, err := g.getMediaTxn(txn, id)
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				response.NotFound = append(response.NotFound, id)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			availability := []LibraryMediaCounts{}
+			for _, counts := range g.getMediaAvailability(txn, id, request.IncludeConsortium) {
+				if libraries != nil && !libraries[counts.Library.Id] {
+					continue
+				}
+				if !filter.matches(counts.Library) {
+					continue
+				}
+				availability = append(availability, counts)
+				rollup, exists := rollups[counts.Library.Id]
+				if !exists {
+					rollup = &BatchLibraryRollup{Library: counts.Library}
+					rollups[counts.Library.Id] = rollup
+				}
+				rollup.Owned++
+				if counts.AvailableCount > 0 {
+					rollup.AvailableNow++
+				}
+			}
+			response.Results = append(response.Results, AvailabilityResponse{
+				SearchResult: g.NewSearchResultTxn(txn, media),
+				Availability: availability,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read batch availability")
+		http.Error(w, "failed to read batch availability", http.StatusInternalServerError)
+		return
+	}
+	for _, rollup := range rollups {
+		response.Libraries = append(response.Libraries, *rollup)
+	}
+	sort.Slice(response.Libraries, func(i, j int) bool {
+		a, b := response.Libraries[i], response.Libraries[j]
+		if a.AvailableNow != b.AvailableNow {
+			return a.AvailableNow > b.AvailableNow
+		}
+		if a.Owned != b.Owned {
+			return a.Owned > b.Owned
+		}
+		return a.Library.Id < b.Library.Id
+	})
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode batch availability")
+	}
+}
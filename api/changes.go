@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/RoaringBitmap/roaring"
+	"github.com/rs/zerolog/log"
+	"sort"
+)
+
+const (
+	reloadModeFull        = "full"
+	reloadModeIncremental = "incremental"
+)
+
+// LibraryChanges holds the media ids that were added, removed or had their
+// counts change at one library during an availability reload
+type LibraryChanges struct {
+	Added   *roaring.Bitmap
+	Removed *roaring.Bitmap
+	Changed *roaring.Bitmap
+}
+
+type AvailabilityChangeSet struct {
+	Snapshot  string
+	Libraries map[uint16]*LibraryChanges
+	// libraryMap of the generation the changes were loaded into
+	libraryMap map[uint16]Library
+}
+
+type LibraryChangeSummary struct {
+	LibraryId string `json:"libraryId"`
+	Added     uint64 `json:"added"`
+	Removed   uint64 `json:"removed"`
+	Changed   uint64 `json:"changed"`
+}
+
+func NewAvailabilityChangeSet(snapshot string, libraryMap map[uint16]Library) *AvailabilityChangeSet {
+	return &AvailabilityChangeSet{
+		Snapshot:   snapshot,
+		Libraries:  map[uint16]*LibraryChanges{},
+		libraryMap: libraryMap,
+	}
+}
+
+func (c *AvailabilityChangeSet) library(libraryIdInt uint16) *LibraryChanges {
+	changes, exists := c.Libraries[libraryIdInt]
+	if !exists {
+		changes = &LibraryChanges{
+			Added:   roaring.New(),
+			Removed: roaring.New(),
+			Changed: roaring.New(),
+		}
+		c.Libraries[libraryIdInt] = changes
+	}
+	return changes
+}
+
+func (c *AvailabilityChangeSet) Added(libraryIdInt uint16, mediaId uint32) {
+	c.library(libraryIdInt).Added.Add(mediaId)
+}
+
+func (c *AvailabilityChangeSet) Removed(libraryIdInt uint16, mediaId uint32) {
+	c.library(libraryIdInt).Removed.Add(mediaId)
+}
+
+func (c *AvailabilityChangeSet) Changed(libraryIdInt uint16, mediaId uint32) {
+	c.library(libraryIdInt).Changed.Add(mediaId)
+}
+
+// Summary returns the per library counts sorted by library id, libraries without changes are left out
+func (c *AvailabilityChangeSet) Summary() []LibraryChangeSummary {
+	summary := make([]LibraryChangeSummary, 0, len(c.Libraries))
+	for libraryIdInt, changes := range c.Libraries {
+		if changes.Added.IsEmpty() && changes.Removed.IsEmpty() && changes.Changed.IsEmpty() {
+			continue
+		}
+		libraryId := ""
+		if library, exists := c.libraryMap[libraryIdInt]; exists {
+			libraryId = library.Id
+		}
+		summary = append(summary, LibraryChangeSummary{
+			LibraryId: libraryId,
+			Added:     changes.Added.GetCardinality(),
+			Removed:   changes.Removed.GetCardinality(),
+			Changed:   changes.Changed.GetCardinality(),
+		})
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		return summary[i].LibraryId < summary[j].LibraryId
+	})
+	return summary
+}
+
+func (c *AvailabilityChangeSet) LogSummary() {
+	var added, removed, changed uint64
+	for _, library := range c.Summary() {
+		log.Info().Str("libraryId", library.LibraryId).
+			Uint64("added", library.Added).
+			Uint64("removed", library.Removed).
+			Uint64("changed", library.Changed).
+			Msg("availability changes")
+		added += library.Added
+		removed += library.Removed
+		changed += library.Changed
+	}
+	log.Info().Str("snapshot", c.Snapshot).
+		Uint64("added", added).
+		Uint64("removed", removed).
+		Uint64("changed", changed).
+		Msg("availability change summary")
+}
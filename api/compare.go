@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+)
+
+// compare expressions combine library ids with set operators over the ownership
+// bitmaps: a | b (union), a & b (intersection) and a - b (difference). & binds
+// tighter than | and -, which are evaluated left to right. parentheses group.
+// library ids can contain -, so a difference needs a space before its -:
+//
+//	(nypl | bpl) - qpl
+//	nypl & lapl & sfpl
+//	kent-county - nypl
+
+type compareExpr interface {
+	eval(g *generation) *roaring.Bitmap
+}
+
+type compareLibrary struct {
+	libraryIdInt uint16
+}
+
+type compareOp struct {
+	op          byte
+	left, right compareExpr
+}
+
+func (e compareLibrary) eval(g *generation) *roaring.Bitmap {
+	return g.libraryBitmap(e.libraryIdInt)
+}
+
+func (e compareOp) eval(g *generation) *roaring.Bitmap {
+	left := e.left.eval(g)
+	right := e.right.eval(g)
+	switch e.op {
+	case '|':
+		return roaring.Or(left, right)
+	case '&':
+		return roaring.And(left, right)
+	default:
+		return roaring.AndNot(left, right)
+	}
+}
+
+var errInvalidExpr = errors.New("invalid expression")
+
+type compareParser struct {
+	g      *generation
+	tokens []string
+	pos    int
+	// libraries lists the libraries named in the expression in order of appearance
+	libraries []uint16
+}
+
+func tokenizeCompareExpr(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '|' || c == '&' || c == '-':
+			tokens = append(tokens, string(c))
+			i++
+		case isLibraryIdChar(c):
+			start := i
+			// a - between id characters is part of the id
+			for i < len(expr) && (isLibraryIdChar(expr[i]) || expr[i] == '-' && i+1 < len(expr) && isLibraryIdChar(expr[i+1])) {
+				i++
+			}
+			tokens = append(tokens, expr[start:i])
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q", errInvalidExpr, c)
+		}
+	}
+	return tokens, nil
+}
+
+func isLibraryIdChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.'
+}
+
+// parseCompareExpr parses expr against the libraries of g
+func (g *generation) parseCompareExpr(expr string) (compareExpr, []uint16, error) {
+	tokens, err := tokenizeCompareExpr(expr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil, fmt.Errorf("%w: empty", errInvalidExpr)
+	}
+	p := &compareParser{g: g, tokens: tokens}
+	e, err := p.parseUnion()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, nil, fmt.Errorf("%w: unexpected %q", errInvalidExpr, p.tokens[p.pos])
+	}
+	return e, p.libraries, nil
+}
+
+func (p *compareParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// parseUnion parses the lowest precedence level, | and -
+func (p *compareParser) parseUnion() (compareExpr, error) {
+	left, err := p.parseIntersect()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "|" || p.peek() == "-" {
+		op := p.tokens[p.pos][0]
+		p.pos++
+		right, err := p.parseIntersect()
+		if err != nil {
+			return nil, err
+		}
+		left = compareOp{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *compareParser) parseIntersect() (compareExpr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&" {
+		p.pos++
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = compareOp{op: '&', left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *compareParser) parseOperand() (compareExpr, error) {
+	token := p.peek()
+	switch token {
+	case "":
+		return nil, fmt.Errorf("%w: unexpected end", errInvalidExpr)
+	case "(":
+		p.pos++
+		e, err := p.parseUnion()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("%w: missing )", errInvalidExpr)
+		}
+		p.pos++
+		return e, nil
+	case ")", "|", "&", "-":
+		return nil, fmt.Errorf("%w: unexpected %q", errInvalidExpr, token)
+	}
+	p.pos++
+	libraryIdInt, _, exists := p.g.lookupLibrary(token)
+	if !exists {
+		if strings.Contains(token, "-") {
+			return nil, fmt.Errorf("%w: unknown library %q, a difference needs spaces around -", errInvalidExpr, token)
+		}
+		return nil, fmt.Errorf("%w: unknown library %q", errInvalidExpr, token)
+	}
+	listed := false
+	for _, id := range p.libraries {
+		listed = listed || id == libraryIdInt
+	}
+	if !listed {
+		p.libraries = append(p.libraries, libraryIdInt)
+	}
+	return compareLibrary{libraryIdInt: libraryIdInt}, nil
+}
+
+type CompareResponse struct {
+	Expr      string               `json:"expr"`
+	Libraries []Library            `json:"libraries"`
+	Total     uint64               `json:"total"`
+	Results   []CompareMediaCounts `json:"results"`
+}
+
+// CompareMediaCounts has the counts of every library in the expression that owns the media
+type CompareMediaCounts struct {
+	*SearchResult
+	Availability []LibraryMediaCounts `json:"availability"`
+}
+
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := parseExportFormat(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expr := r.URL.Query().Get("expr")
+	e, libraryIdInts, err := g.parseCompareExpr(expr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Info().Msgf("/api/compare expr: %s", expr)
+	bitmap := e.eval(g)
+	libraries := make([]Library, 0, len(libraryIdInts))
+	for _, libraryIdInt := range libraryIdInts {
+		library, _ := g.library(libraryIdInt)
+		libraries = append(libraries, library)
+	}
+	results := newRecordWriter[CompareMediaCounts](w, r, bitmap.GetCardinality(), "compare")
+	err = db.View(func(txn *badger.Txn) error {
+		for _, id := range page.ids(bitmap) {
+			media, err := g.getMediaTxn(txn, id)
+			if err != nil {
+				return err
+			}
+			result := CompareMediaCounts{
+				SearchResult: g.NewSearchResultTxn(txn, media),
+				Availability: []LibraryMediaCounts{},
+			}
+			for i, libraryIdInt := range libraryIdInts {
+				if !g.libraryBitmap(libraryIdInt).Contains(id) {
+					continue
+				}
+				counts, err := g.getLibraryMediaCounts(txn, libraryIdInt, id)
+				if err != nil {
+					return err
+				}
+				result.Availability = append(result.Availability, LibraryMediaCounts{
+					Library:           libraries[i],
+					MediaCountResults: g.NewMediaCountResults(counts),
+				})
+			}
+			if err := results.Write(result); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		results.Fail(err, "failed to read compare results")
+		return
+	}
+	log.Info().Uint64("total", bitmap.GetCardinality()).Bool("streamed", results.Streaming()).Msg("compare complete")
+	if results.Streaming() {
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(CompareResponse{
+		Expr:      expr,
+		Libraries: libraries,
+		Total:     bitmap.GetCardinality(),
+		Results:   results.records,
+	})
+	if err != nil {
+		log.Error().Err(err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"github.com/RoaringBitmap/roaring"
+	"reflect"
+	"testing"
+)
+
+// useDefaultLibraryRules makes the default rules current for the test
+func useDefaultLibraryRules(t *testing.T) {
+	previous := libraryRules.Load()
+	libraryRules.Store(defaultLibraryRules())
+	t.Cleanup(func() { libraryRules.Store(previous) })
+}
+
+func TestParseCompareExpr(t *testing.T) {
+	useDefaultLibraryRules(t)
+	g := newGeneration(0)
+	for libraryIdInt, library := range map[uint16]struct {
+		id    string
+		owned []uint32
+	}{
+		1: {"nypl", []uint32{1, 2, 3}},
+		2: {"bpl", []uint32{2, 3, 4}},
+		3: {"kent-county", []uint32{3, 5}},
+	} {
+		g.libraryIdMap[library.id] = libraryIdInt
+		g.libraryMap[libraryIdInt] = Library{Id: library.id}
+		g.libraryBitmaps[libraryIdInt] = roaring.BitmapOf(library.owned...)
+	}
+	tests := []struct {
+		expr      string
+		want      []uint32
+		libraries []uint16
+	}{
+		{"nypl - bpl", []uint32{1}, []uint16{1, 2}},
+		{"nypl | bpl", []uint32{1, 2, 3, 4}, []uint16{1, 2}},
+		{"kent-county", []uint32{3, 5}, []uint16{3}},
+		{"kent-county - nypl", []uint32{5}, []uint16{3, 1}},
+		{"nypl -kent-county", []uint32{1, 2}, []uint16{1, 3}},
+		{"(nypl | kent-county) & bpl", []uint32{2, 3}, []uint16{1, 3, 2}},
+		{"nypl & bpl | kent-county", []uint32{2, 3, 5}, []uint16{1, 2, 3}},
+		{"nypl - bpl - kent-county", []uint32{1}, []uint16{1, 2, 3}},
+		{"nypl | nypl", []uint32{1, 2, 3}, []uint16{1}},
+	}
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			e, libraries, err := g.parseCompareExpr(test.expr)
+			if err != nil {
+				t.Fatalf("parseCompareExpr(%q): %v", test.expr, err)
+			}
+			if got := e.eval(g).ToArray(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("eval = %v, want %v", got, test.want)
+			}
+			if !reflect.DeepEqual(libraries, test.libraries) {
+				t.Errorf("libraries = %v, want %v", libraries, test.libraries)
+			}
+		})
+	}
+	for _, expr := range []string{"", "nypl-bpl", "nypl -", "- nypl", "kent-", "(nypl", "nypl)", "nypl bpl", "nypl & & bpl", "nypl + bpl", "lapl"} {
+		t.Run("invalid "+expr, func(t *testing.T) {
+			if _, _, err := g.parseCompareExpr(expr); !errors.Is(err, errInvalidExpr) {
+				t.Errorf("parseCompareExpr(%q) = %v, want an invalid expression", expr, err)
+			}
+		})
+	}
+}
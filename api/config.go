@@ -0,0 +1,299 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Config is everything that used to be hardcoded or read with os.Getenv.
+// values are applied in order: defaults, config file, environment, flags.
+// the env and flag tags name the environment variable and command line flag
+type Config struct {
+	LocalTesting bool   `yaml:"localTesting" env:"LOCAL_TESTING" flag:"local-testing" usage:"read data from ../../librarylibrary and serve plain http on localhost"`
+	LoadOnly     bool   `yaml:"loadOnly" env:"LOAD_ONLY" flag:"load-only" usage:"load data into badger and exit"`
+	LogLevel     string `yaml:"logLevel" env:"LOG_LEVEL" flag:"log-level" usage:"zerolog level, defaults to debug when local testing and info otherwise"`
+
+	Host        string `yaml:"host" env:"HOST" flag:"host" usage:"address to listen on"`
+	Port        int    `yaml:"port" env:"PORT" flag:"port" usage:"port to listen on, defaults to 8080 when local testing and 443 otherwise"`
+	TLSCertFile string `yaml:"tlsCertFile" env:"TLS_CERT_FILE" flag:"tls-cert-file" usage:"tls certificate, defaults to the letsencrypt one of deeplibby.com unless local testing or tls-disabled"`
+	TLSKeyFile  string `yaml:"tlsKeyFile" env:"TLS_KEY_FILE" flag:"tls-key-file" usage:"tls private key"`
+	TLSDisabled bool   `yaml:"tlsDisabled" env:"TLS_DISABLED" flag:"tls-disabled" usage:"serve plain http, e.g. behind a proxy that terminates tls"`
+
+	BadgerDir         string  `yaml:"badgerDir" env:"BADGER_DIR" flag:"badger-dir" usage:"badger database directory"`
+	DataSource        string  `yaml:"dataSource" env:"DATA_SOURCE" flag:"data-source" usage:"where to read the csv.gz dataset from: file://, s3:// or https://"`
+	IngestErrorBudget float64 `yaml:"ingestErrorBudget" env:"INGEST_ERROR_BUDGET" flag:"ingest-error-budget" usage:"share of rejected rows (0-1) a loader tolerates before failing"`
+	QuarantineDir     string  `yaml:"quarantineDir" env:"QUARANTINE_DIR" flag:"quarantine-dir" usage:"directory for rejected csv rows"`
+
+	SnapshotDate           string        `yaml:"snapshotDate" env:"SNAPSHOT_DATE" flag:"snapshot-date" usage:"date (YYYY-MM-DD) the availability load is recorded under in the history, defaults to today"`
+	HistoryRetentionDays   int           `yaml:"historyRetentionDays" env:"HISTORY_RETENTION_DAYS" flag:"history-retention-days" usage:"days of availability history to keep, 0 keeps everything"`
+	AvailabilityReloadMode string        `yaml:"availabilityReloadMode" env:"AVAILABILITY_RELOAD_MODE" flag:"availability-reload-mode" usage:"full rewrites availability only when badger is empty (or load-only), incremental diffs every load against the stored keys"`
+	ReloadInterval         time.Duration `yaml:"reloadInterval" env:"RELOAD_INTERVAL" flag:"reload-interval" usage:"reload the data source into a new generation this often, 0 only reloads on SIGHUP or /api/admin/reload"`
+
+	AdminToken string `yaml:"adminToken" env:"ADMIN_TOKEN" flag:"admin-token" usage:"bearer token for the /api/admin endpoints, empty disables them" secret:"true"`
+	// LibraryRulesFile is only used until rules are saved through /api/admin/library-rules
+	LibraryRulesFile string `yaml:"libraryRulesFile" env:"LIBRARY_RULES_FILE" flag:"library-rules-file" usage:"yaml file with the library rules, by default uskindle is hidden"`
+	SMTPAddr         string `yaml:"smtpAddr" env:"SMTP_ADDR" flag:"smtp-addr" usage:"host:port of the smtp server watchlist alerts are emailed through, empty disables email"`
+	SMTPFrom         string `yaml:"smtpFrom" env:"SMTP_FROM" flag:"smtp-from" usage:"sender address of watchlist alert emails"`
+	SMTPUsername     string `yaml:"smtpUsername" env:"SMTP_USERNAME" flag:"smtp-username" usage:"smtp username, empty sends without auth"`
+	SMTPPassword     string `yaml:"smtpPassword" env:"SMTP_PASSWORD" flag:"smtp-password" usage:"smtp password" secret:"true"`
+
+	MaxBatchSize int `yaml:"maxBatchSize" env:"MAX_BATCH_SIZE" flag:"max-batch-size" usage:"most media ids a POST /api/availability/batch can ask for"`
+
+	S3Bucket string `yaml:"s3Bucket" env:"S3_BUCKET" flag:"s3-bucket" usage:"bucket the ui is served from"`
+	S3Region string `yaml:"s3Region" env:"S3_REGION" flag:"s3-region" usage:"region of the s3 bucket"`
+	UIPrefix string `yaml:"uiPrefix" env:"UI_PREFIX" flag:"ui-prefix" usage:"key prefix of the ui build in the s3 bucket"`
+
+	HardcoverAPIToken string `yaml:"hardcoverApiToken" env:"HARDCOVER_API_TOKEN" flag:"hardcover-api-token" usage:"bearer token for the hardcover graphql api" secret:"true"`
+}
+
+var cfg = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Host:                   "0.0.0.0",
+		BadgerDir:              "deeplibby.badger",
+		IngestErrorBudget:      defaultIngestErrorBudget,
+		QuarantineDir:          "quarantine",
+		HistoryRetentionDays:   365,
+		MaxBatchSize:           100,
+		SMTPFrom:               "alerts@deeplibby.com",
+		AvailabilityReloadMode: reloadModeFull,
+		S3Bucket:               "deep-libby",
+		S3Region:               "us-east-1",
+		UIPrefix:               "ui",
+	}
+}
+
+// loadConfig builds the config from args (without the program name). it also
+// reports whether --print-config was passed
+func loadConfig(args []string) (*Config, bool, error) {
+	c := defaultConfig()
+	fs := flag.NewFlagSet("deeplibby", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "optional yaml config file")
+	printConfig := fs.Bool("print-config", false, "print the resolved config and exit")
+	flagValues := map[string]*string{}
+	forEachConfigField(c, func(field reflect.StructField, value reflect.Value) {
+		name := field.Tag.Get("flag")
+		flagValues[name] = new(string)
+		// bool flags can be passed as just --load-only
+		if value.Kind() == reflect.Bool {
+			fs.Var(&boolFlag{value: flagValues[name]}, name, field.Tag.Get("usage"))
+			return
+		}
+		fs.Func(name, field.Tag.Get("usage"), func(s string) error {
+			*flagValues[name] = s
+			return nil
+		})
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	if *configFile != "" {
+		f, err := os.Open(*configFile)
+		if err != nil {
+			return nil, false, fmt.Errorf("opening config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		err = decoder.Decode(c)
+		f.Close()
+		if err != nil && err != io.EOF {
+			return nil, false, fmt.Errorf("parsing config file %s: %w", *configFile, err)
+		}
+	}
+
+	var err error
+	forEachConfigField(c, func(field reflect.StructField, value reflect.Value) {
+		if err != nil {
+			return
+		}
+		if env, ok := os.LookupEnv(field.Tag.Get("env")); ok && env != "" {
+			if setErr := setConfigField(value, env); setErr != nil {
+				err = fmt.Errorf("%s: %w", field.Tag.Get("env"), setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		forEachConfigField(c, func(field reflect.StructField, value reflect.Value) {
+			if field.Tag.Get("flag") != f.Name {
+				return
+			}
+			if setErr := setConfigField(value, *flagValues[f.Name]); setErr != nil {
+				err = fmt.Errorf("--%s: %w", f.Name, setErr)
+			}
+		})
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	c.applyModeDefaults()
+	return c, *printConfig, c.Validate()
+}
+
+// applyModeDefaults fills in the defaults that depend on LocalTesting
+func (c *Config) applyModeDefaults() {
+	if c.LogLevel == "" {
+		c.LogLevel = zerolog.InfoLevel.String()
+		if c.LocalTesting {
+			c.LogLevel = zerolog.DebugLevel.String()
+		}
+	}
+	if c.LocalTesting {
+		if c.Port == 0 {
+			c.Port = 8080
+		}
+		if c.Host == "0.0.0.0" {
+			c.Host = "localhost"
+		}
+	} else {
+		if c.Port == 0 {
+			c.Port = 443
+		}
+		if c.TLSCertFile == "" && c.TLSKeyFile == "" && !c.TLSDisabled {
+			c.TLSCertFile = "/etc/letsencrypt/live/deeplibby.com/fullchain.pem"
+			c.TLSKeyFile = "/etc/letsencrypt/live/deeplibby.com/privkey.pem"
+		}
+	}
+	if c.DataSource == "" {
+		c.DataSource = "s3://" + c.S3Bucket + "?region=" + c.S3Region
+		if c.LocalTesting {
+			c.DataSource = "file://../../librarylibrary"
+		}
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("tlsCertFile and tlsKeyFile must be set together")
+	}
+	if c.TLSDisabled && c.TLSCertFile != "" {
+		return fmt.Errorf("tlsCertFile and tlsKeyFile can't be set with tlsDisabled")
+	}
+	if c.BadgerDir == "" {
+		return fmt.Errorf("badgerDir is required")
+	}
+	if c.IngestErrorBudget < 0 || c.IngestErrorBudget > 1 {
+		return fmt.Errorf("ingestErrorBudget must be between 0 and 1, got %v", c.IngestErrorBudget)
+	}
+	if _, err := zerolog.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("invalid logLevel %q", c.LogLevel)
+	}
+	if c.SnapshotDate != "" {
+		if _, err := time.Parse(historyDateFormat, c.SnapshotDate); err != nil {
+			return fmt.Errorf("invalid snapshotDate %q, expected YYYY-MM-DD", c.SnapshotDate)
+		}
+	}
+	if c.MaxBatchSize < 1 {
+		return fmt.Errorf("maxBatchSize must be at least 1")
+	}
+	if c.HistoryRetentionDays < 0 {
+		return fmt.Errorf("historyRetentionDays can't be negative")
+	}
+	if c.AvailabilityReloadMode != reloadModeFull && c.AvailabilityReloadMode != reloadModeIncremental {
+		return fmt.Errorf("availabilityReloadMode must be %s or %s", reloadModeFull, reloadModeIncremental)
+	}
+	if c.S3Bucket == "" {
+		return fmt.Errorf("s3Bucket is required")
+	}
+	return nil
+}
+
+func (c *Config) ListenAddr() string {
+	return fmt.Sprintf("%s:%d", c.Host, c.Port)
+}
+
+// Print writes the config as yaml with secrets redacted
+func (c *Config) Print(w io.Writer) error {
+	redacted := *c
+	forEachConfigField(&redacted, func(field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("secret") == "true" && value.String() != "" {
+			value.SetString("<redacted>")
+		}
+	})
+	encoder := yaml.NewEncoder(w)
+	defer encoder.Close()
+	return encoder.Encode(redacted)
+}
+
+func forEachConfigField(c *Config, fn func(field reflect.StructField, value reflect.Value)) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		fn(t.Field(i), v.Field(i))
+	}
+}
+
+func setConfigField(value reflect.Value, s string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		if value.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			value.SetInt(int64(d))
+			return nil
+		}
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported config type %s", value.Type())
+	}
+	return nil
+}
+
+// boolFlag records the raw value like the other config flags, IsBoolFlag lets it be used without =true
+type boolFlag struct {
+	value *string
+}
+
+func (b *boolFlag) String() string {
+	if b.value == nil {
+		return ""
+	}
+	return *b.value
+}
+
+func (b *boolFlag) Set(s string) error {
+	*b.value = s
+	return nil
+}
+
+func (b *boolFlag) IsBoolFlag() bool {
+	return true
+}
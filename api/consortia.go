@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+)
+
+// consortium collections are shared with their member libraries. membership
+// comes from the optional consortia.csv.gz (consortiumId, libraryId), handlers
+// merge consortium holdings into a member's view with includeConsortium=true
+
+// LibrarySource labels where the copies in merged counts come from
+type LibrarySource struct {
+	LibraryId  string `json:"libraryId"`
+	Consortium bool   `json:"consortium"`
+	MediaCountResults
+}
+
+// readConsortia loads consortia.csv.gz, libraries need to be loaded first
+func (g *generation) readConsortia() error {
+	cr, closer, err := openGzipCSV(dataSource, "consortia.csv.gz")
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Info().Msg("no consortia.csv.gz, skipping consortium membership")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	report := newIngestReport("consortia")
+	for {
+		record, line, err := report.readRow(cr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading consortia: %w", err)
+		}
+		consortiumIdInt, memberIdInt, err := g.parseConsortiumRecord(record)
+		if err != nil {
+			report.reject(line, err.Error(), record)
+			continue
+		}
+		g.consortia[memberIdInt] = append(g.consortia[memberIdInt], consortiumIdInt)
+		g.consortiumMembers[consortiumIdInt] = append(g.consortiumMembers[consortiumIdInt], memberIdInt)
+		report.accept()
+	}
+	log.Info().Int("consortia", len(g.consortiumMembers)).Msg("done reading consortia")
+	return report.finish()
+}
+
+// parseConsortiumRecord validates a row of consortia.csv.gz: consortiumId, libraryId
+func (g *generation) parseConsortiumRecord(record []string) (uint16, uint16, error) {
+	if err := checkFieldCount(record, 2); err != nil {
+		return 0, 0, err
+	}
+	consortiumIdInt, exists := g.libraryIdMap[record[0]]
+	if !exists {
+		return 0, 0, fmt.Errorf("consortium id not found %q", record[0])
+	}
+	memberIdInt, exists := g.libraryIdMap[record[1]]
+	if !exists {
+		return 0, 0, fmt.Errorf("library id not found %q", record[1])
+	}
+	if consortiumIdInt == memberIdInt {
+		return 0, 0, fmt.Errorf("library %q can't be its own consortium", record[0])
+	}
+	for _, existing := range g.consortia[memberIdInt] {
+		if existing == consortiumIdInt {
+			return 0, 0, fmt.Errorf("duplicate membership of %q in %q", record[1], record[0])
+		}
+	}
+	return consortiumIdInt, memberIdInt, nil
+}
+
+func includeConsortium(r *http.Request) bool {
+	return r.URL.Query().Get("includeConsortium") == "true"
+}
+
+// visibleConsortia are the consortia of a library that aren't hidden by the library rules
+func (g *generation) visibleConsortia(libraryIdInt uint16) []uint16 {
+	var consortia []uint16
+	for _, consortiumIdInt := range g.consortia[libraryIdInt] {
+		if _, visible := g.library(consortiumIdInt); visible {
+			consortia = append(consortia, consortiumIdInt)
+		}
+	}
+	return consortia
+}
+
+// effectiveBitmap is what the patrons of a library can borrow, its own
+// collection plus the collections of its consortia when merging
+func (g *generation) effectiveBitmap(libraryIdInt uint16, withConsortium bool) *roaring.Bitmap {
+	consortia := g.visibleConsortia(libraryIdInt)
+	if !withConsortium || len(consortia) == 0 {
+		return g.libraryBitmap(libraryIdInt)
+	}
+	bitmap := g.libraryBitmap(libraryIdInt).Clone()
+	for _, consortiumIdInt := range consortia {
+		bitmap.Or(g.libraryBitmap(consortiumIdInt))
+	}
+	return bitmap
+}
+
+// uniqueWithConsortia is what only the patrons of a library can borrow, through
+// its own collection or its consortia
+func (g *generation) uniqueWithConsortia(libraryIdInt uint16) *roaring.Bitmap {
+	excluded := map[uint16]bool{libraryIdInt: true}
+	for _, consortiumIdInt := range g.consortia[libraryIdInt] {
+		excluded[consortiumIdInt] = true
+	}
+	others := roaring.New()
+	for otherIdInt := range g.visibility().libraries {
+		if !excluded[otherIdInt] {
+			others.Or(g.libraryBitmap(otherIdInt))
+		}
+	}
+	return roaring.AndNot(g.effectiveBitmap(libraryIdInt, true), others)
+}
+
+// getMergedMediaCounts reads the counts of a media at a library, merged with its
+// consortia when withConsortium is set. sources is nil when nothing was merged
+func (g *generation) getMergedMediaCounts(txn *badger.Txn, libraryIdInt uint16, mediaId uint32, withConsortium bool) (*MediaCounts, []LibrarySource, error) {
+	consortia := g.visibleConsortia(libraryIdInt)
+	if !withConsortium || len(consortia) == 0 {
+		counts, err := g.getLibraryMediaCounts(txn, libraryIdInt, mediaId)
+		return counts, nil, err
+	}
+	var all []*MediaCounts
+	var sources []LibrarySource
+	for i, sourceIdInt := range append([]uint16{libraryIdInt}, consortia...) {
+		if !g.libraryBitmap(sourceIdInt).Contains(mediaId) {
+			continue
+		}
+		counts, err := g.getLibraryMediaCounts(txn, sourceIdInt, mediaId)
+		if err != nil {
+			return nil, nil, err
+		}
+		all = append(all, counts)
+		sources = append(sources, LibrarySource{
+			LibraryId:         g.libraryMap[sourceIdInt].Id,
+			Consortium:        i > 0,
+			MediaCountResults: g.NewMediaCountResults(counts),
+		})
+	}
+	if len(all) == 0 {
+		return nil, nil, badger.ErrKeyNotFound
+	}
+	return mergeMediaCounts(all), sources, nil
+}
+
+// saturatingAdd adds counts, stopping at math.MaxUint16 instead of wrapping around
+func saturatingAdd(a, b uint16) uint16 {
+	if a > math.MaxUint16-b {
+		return math.MaxUint16
+	}
+	return a + b
+}
+
+// mergeMediaCounts adds up the copies of several sources, the wait (and its
+// range) is the shortest one since a patron can place the hold wherever it's shortest
+func mergeMediaCounts(all []*MediaCounts) *MediaCounts {
+	merged := &MediaCounts{
+		EstimatedWaitDays: all[0].EstimatedWaitDays,
+		WaitDaysLow:       all[0].WaitDaysLow,
+		WaitDaysHigh:      all[0].WaitDaysHigh,
+	}
+	seenFormats := map[uint8]bool{}
+	for _, counts := range all {
+		merged.OwnedCount = saturatingAdd(merged.OwnedCount, counts.OwnedCount)
+		merged.AvailableCount = saturatingAdd(merged.AvailableCount, counts.AvailableCount)
+		merged.HoldsCount = saturatingAdd(merged.HoldsCount, counts.HoldsCount)
+		if counts.EstimatedWaitDays < merged.EstimatedWaitDays {
+			merged.EstimatedWaitDays = counts.EstimatedWaitDays
+			merged.WaitDaysLow = counts.WaitDaysLow
+			merged.WaitDaysHigh = counts.WaitDaysHigh
+		}
+		for _, format := range counts.Formats {
+			if !seenFormats[format] {
+				seenFormats[format] = true
+				merged.Formats = append(merged.Formats, format)
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DataSource opens the dataset files (libraries.csv.gz, media.csv.gz, ...) by
+// name. a missing file is reported with an error wrapping fs.ErrNotExist so
+// optional files can be skipped
+type DataSource interface {
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	String() string
+}
+
+var dataSource DataSource
+
+// NewDataSource picks the implementation from the uri scheme:
+//
+//	file:///data/librarylibrary or a plain path
+//	s3://bucket/prefix?region=us-east-1&endpoint=http://localhost:9000
+//	https://example.com/librarylibrary/
+func NewDataSource(uri string) (DataSource, error) {
+	switch {
+	case strings.HasPrefix(uri, "file://"):
+		return &fileDataSource{dir: strings.TrimPrefix(uri, "file://")}, nil
+	case strings.HasPrefix(uri, "s3://"):
+		return newS3DataSource(uri)
+	case strings.HasPrefix(uri, "https://"), strings.HasPrefix(uri, "http://"):
+		return newHTTPDataSource(uri)
+	case strings.Contains(uri, "://"):
+		return nil, fmt.Errorf("unsupported data source %q", uri)
+	default:
+		return &fileDataSource{dir: uri}, nil
+	}
+}
+
+type gzipCSVCloser struct {
+	gzr  *gzip.Reader
+	body io.ReadCloser
+}
+
+func (c *gzipCSVCloser) Close() error {
+	gzErr := c.gzr.Close()
+	err := c.body.Close()
+	if gzErr != nil {
+		return gzErr
+	}
+	return err
+}
+
+// openGzipCSV opens a gzipped csv from the data source. the returned closer
+// closes both the gzip stream and the underlying body
+func openGzipCSV(src DataSource, name string) (*csv.Reader, io.Closer, error) {
+	body, err := src.Open(context.TODO(), name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening %s from %s: %w", name, src, err)
+	}
+	gzr, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, nil, fmt.Errorf("opening %s from %s: %w", name, src, err)
+	}
+	return newCSVReader(gzr), &gzipCSVCloser{gzr: gzr, body: body}, nil
+}
+
+type fileDataSource struct {
+	dir string
+}
+
+func (f *fileDataSource) Open(_ context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(f.dir, name))
+}
+
+func (f *fileDataSource) String() string {
+	return "file://" + f.dir
+}
+
+type s3DataSource struct {
+	client *s3.Client
+	bucket string
+	prefix string
+	uri    string
+}
+
+func newS3DataSource(uri string) (*s3DataSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 data source %q: %w", uri, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 data source %q: missing bucket", uri)
+	}
+	region := u.Query().Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := u.Query().Get("endpoint")
+	awsConfig, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("loading aws config: %w", err)
+	}
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if endpoint != "" {
+			// custom endpoints (minio and friends) generally don't do virtual host buckets
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return &s3DataSource{
+		client: client,
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		uri:    uri,
+	}, nil
+}
+
+func (s *s3DataSource) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, name)),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3DataSource) String() string {
+	return s.uri
+}
+
+type httpDataSource struct {
+	client  *http.Client
+	baseUrl *url.URL
+}
+
+func newHTTPDataSource(uri string) (*httpDataSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http data source %q: %w", uri, err)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &httpDataSource{client: &http.Client{}, baseUrl: u}, nil
+}
+
+func (h *httpDataSource) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	u := h.baseUrl.JoinPath(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %w", u, fs.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (h *httpDataSource) String() string {
+	return h.baseUrl.String()
+}
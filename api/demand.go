@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sort"
+)
+
+const (
+	// defaultDemandLimit is the page size of the demand report without a limit
+	defaultDemandLimit = 50
+	// defaultDemandPeers is how many of the most similar libraries are compared without peerLibraryId
+	defaultDemandPeers = 5
+)
+
+type DemandResponse struct {
+	Library Library             `json:"library"`
+	Peers   []Library           `json:"peers"`
+	Total   int                 `json:"total"`
+	Demand  []DemandMediaCounts `json:"demand"`
+}
+
+// DemandMediaCounts is a title under hold pressure at a library, with the counts
+// of the peers that own it for comparison
+type DemandMediaCounts struct {
+	*SearchResult
+	LibraryMediaCounts
+	HoldsPerCopy float64              `json:"holdsPerCopy"`
+	Peers        []LibraryMediaCounts `json:"peers"`
+}
+
+func (d DemandMediaCounts) exportRows(g *generation) []exportRow {
+	rows := []exportRow{{result: d.SearchResult, library: &d.Library, counts: &d.MediaCountResults}}
+	for i := range d.Peers {
+		rows = append(rows, exportRow{result: d.SearchResult, library: &d.Peers[i].Library, counts: &d.Peers[i].MediaCountResults})
+	}
+	return rows
+}
+
+type demandEntry struct {
+	mediaId      uint32
+	counts       *MediaCounts
+	holdsPerCopy float64
+}
+
+func holdsPerCopy(counts *MediaCounts) float64 {
+	if counts.OwnedCount == 0 {
+		return float64(counts.HoldsCount)
+	}
+	return float64(counts.HoldsCount) / float64(counts.OwnedCount)
+}
+
+// demandEntries returns the titles of a library with holds, worst holds per copy first
+func (g *generation) demandEntries(txn *badger.Txn, libraryIdInt uint16) ([]demandEntry, error) {
+	var entries []demandEntry
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = g.getLibraryAvailabilityPrefix(libraryIdInt)
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		counts, err := g.decodeLibraryMediaCounts(libraryIdInt, val)
+		if err != nil {
+			return nil, err
+		}
+		if counts.HoldsCount == 0 {
+			continue
+		}
+		entries = append(entries, demandEntry{
+			mediaId:      binary.BigEndian.Uint32(g.trimNamespace(item.Key())[4:]),
+			counts:       counts,
+			holdsPerCopy: holdsPerCopy(counts),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].holdsPerCopy != entries[j].holdsPerCopy {
+			return entries[i].holdsPerCopy > entries[j].holdsPerCopy
+		}
+		if entries[i].counts.EstimatedWaitDays != entries[j].counts.EstimatedWaitDays {
+			return entries[i].counts.EstimatedWaitDays > entries[j].counts.EstimatedWaitDays
+		}
+		return entries[i].mediaId < entries[j].mediaId
+	})
+	return entries, nil
+}
+
+func libraryDemandHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if page.Limit < 0 {
+		page.Limit = defaultDemandLimit
+	}
+	if _, err := parseExportFormat(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	libraryIdInt, library, exists := g.lookupLibrary(r.URL.Query().Get("libraryId"))
+	if !exists {
+		http.Error(w, "invalid library id", http.StatusBadRequest)
+		return
+	}
+	// peers are the libraries asked for, or the most similar collections
+	var peerIdInts []uint16
+	peers := []Library{}
+	for _, peerId := range queryValues(r, "peerLibraryId") {
+		peerIdInt, peer, exists := g.lookupLibrary(peerId)
+		if !exists {
+			http.Error(w, "invalid library id "+peerId, http.StatusBadRequest)
+			return
+		}
+		peerIdInts = append(peerIdInts, peerIdInt)
+		peers = append(peers, peer)
+	}
+	if len(peerIdInts) == 0 {
+		for _, similar := range g.similarLibraries(libraryIdInt) {
+			if len(peerIdInts) == defaultDemandPeers {
+				break
+			}
+			peerIdInts = append(peerIdInts, g.libraryIdMap[similar.Library.Id])
+			peers = append(peers, similar.Library)
+		}
+	}
+	log.Info().Msgf("/api/library/demand libraryId %s", library.Id)
+	var entries []demandEntry
+	var demand *recordWriter[DemandMediaCounts]
+	err = db.View(func(txn *badger.Txn) error {
+		var err error
+		entries, err = g.demandEntries(txn, libraryIdInt)
+		if err != nil {
+			return err
+		}
+		demand = newRecordWriter[DemandMediaCounts](w, r, uint64(len(entries)), "demand-"+library.Id)
+		start := min(page.Offset, len(entries))
+		end := min(start+page.Limit, len(entries))
+		for _, entry := range entries[start:end] {
+			media, err := g.getMediaTxn(txn, entry.mediaId)
+			if err != nil {
+				return err
+			}
+			record := DemandMediaCounts{
+				SearchResult: g.NewSearchResultTxn(txn, media),
+				LibraryMediaCounts: LibraryMediaCounts{
+					Library:           library,
+					MediaCountResults: g.NewMediaCountResults(entry.counts),
+				},
+				HoldsPerCopy: entry.holdsPerCopy,
+				Peers:        []LibraryMediaCounts{},
+			}
+			for i, peerIdInt := range peerIdInts {
+				if !g.libraryBitmap(peerIdInt).Contains(entry.mediaId) {
+					continue
+				}
+				counts, err := g.getLibraryMediaCounts(txn, peerIdInt, entry.mediaId)
+				if err != nil {
+					return err
+				}
+				record.Peers = append(record.Peers, LibraryMediaCounts{
+					Library:           peers[i],
+					MediaCountResults: g.NewMediaCountResults(counts),
+				})
+			}
+			if err := demand.Write(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if demand == nil {
+			log.Error().Err(err).Msg("failed to read library demand")
+			http.Error(w, "failed to read library demand", http.StatusInternalServerError)
+			return
+		}
+		demand.Fail(err, "failed to read library demand")
+		return
+	}
+	if demand.Streaming() {
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(DemandResponse{
+		Library: library,
+		Peers:   peers,
+		Total:   len(entries),
+		Demand:  demand.records,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode library demand")
+	}
+}
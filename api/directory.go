@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the library directory: libraries are searchable by name and city, and the
+// optional libraries-enrichment.csv.gz (libraryId, country, state, city,
+// latitude, longitude, homepage) adds where they are
+
+const earthRadiusKm = 6371.0
+
+// readLibraryEnrichment loads libraries-enrichment.csv.gz into g.libraryMap and
+// indexes every library for name search, libraries need to be loaded first
+func (g *generation) readLibraryEnrichment() error {
+	defer g.indexLibraries()
+	cr, closer, err := openGzipCSV(dataSource, "libraries-enrichment.csv.gz")
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Info().Msg("no libraries-enrichment.csv.gz, skipping library locations")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	report := newIngestReport("libraries-enrichment")
+	for {
+		record, line, err := report.readRow(cr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading library enrichment: %w", err)
+		}
+		libraryIdInt, library, err := g.parseLibraryEnrichmentRecord(record)
+		if err != nil {
+			report.reject(line, err.Error(), record)
+			continue
+		}
+		g.libraryMap[libraryIdInt] = library
+		report.accept()
+	}
+	log.Info().Msg("done reading library enrichment")
+	return report.finish()
+}
+
+// parseLibraryEnrichmentRecord validates a row of libraries-enrichment.csv.gz:
+// libraryId, country, state, city, latitude, longitude, homepage. coordinates
+// are either both set or both empty
+func (g *generation) parseLibraryEnrichmentRecord(record []string) (uint16, Library, error) {
+	if err := checkFieldCount(record, 7); err != nil {
+		return 0, Library{}, err
+	}
+	libraryIdInt, exists := g.libraryIdMap[record[0]]
+	if !exists {
+		return 0, Library{}, fmt.Errorf("library id not found %q", record[0])
+	}
+	library := g.libraryMap[libraryIdInt]
+	library.Country = strings.TrimSpace(record[1])
+	library.State = strings.TrimSpace(record[2])
+	library.City = strings.TrimSpace(record[3])
+	if record[4] != "" || record[5] != "" {
+		latitude, err := strconv.ParseFloat(record[4], 64)
+		if err != nil || latitude < -90 || latitude > 90 {
+			return 0, Library{}, fmt.Errorf("invalid latitude %q", record[4])
+		}
+		longitude, err := strconv.ParseFloat(record[5], 64)
+		if err != nil || longitude < -180 || longitude > 180 {
+			return 0, Library{}, fmt.Errorf("invalid longitude %q", record[5])
+		}
+		library.Latitude = &latitude
+		library.Longitude = &longitude
+	}
+	if record[6] != "" {
+		homepage, err := url.Parse(record[6])
+		if err != nil || (homepage.Scheme != "http" && homepage.Scheme != "https") || homepage.Host == "" {
+			return 0, Library{}, fmt.Errorf("invalid homepage %q", record[6])
+		}
+		library.Homepage = record[6]
+	}
+	return libraryIdInt, library, nil
+}
+
+// indexLibraries indexes the id, name and city of every library by their int id
+func (g *generation) indexLibraries() {
+	for libraryIdInt, library := range g.libraryMap {
+		for _, name := range []string{library.Id, library.Name, library.City} {
+			if name != "" {
+				g.librarySearch.Index(name, uint32(libraryIdInt))
+			}
+		}
+	}
+}
+
+// searchLibraries returns the int ids of the libraries matching a name query
+func (g *generation) searchLibraries(query string) *roaring.Bitmap {
+	results := g.librarySearch.SearchBitmapResult(query)
+	if results == nil {
+		return roaring.New()
+	}
+	return results
+}
+
+// distanceKm is the great circle distance between two coordinates
+func distanceKm(latitude1, longitude1, latitude2, longitude2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLatitude := toRadians(latitude2 - latitude1)
+	dLongitude := toRadians(longitude2 - longitude1)
+	a := math.Sin(dLatitude/2)*math.Sin(dLatitude/2) +
+		math.Cos(toRadians(latitude1))*math.Cos(toRadians(latitude2))*math.Sin(dLongitude/2)*math.Sin(dLongitude/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// libraryFilter restricts libraries by location, the zero value matches every library
+type libraryFilter struct {
+	country string
+	state   string
+	city    string
+	// near is set when the libraries are filtered by distance from latitude, longitude
+	near      bool
+	latitude  float64
+	longitude float64
+	// radiusKm is 0 when libraries at any distance match
+	radiusKm float64
+}
+
+var errInvalidLibraryFilter = errors.New("invalid library filter")
+
+// parseLibraryFilter reads the country, state, city, near=latitude,longitude and
+// radiusKm query params
+func parseLibraryFilter(r *http.Request) (libraryFilter, error) {
+	query := r.URL.Query()
+	filter := libraryFilter{
+		country: strings.TrimSpace(query.Get("country")),
+		state:   strings.TrimSpace(query.Get("state")),
+		city:    strings.TrimSpace(query.Get("city")),
+	}
+	if near := query.Get("near"); near != "" {
+		latitude, longitude, found := strings.Cut(near, ",")
+		var err error
+		filter.latitude, err = strconv.ParseFloat(strings.TrimSpace(latitude), 64)
+		if err != nil || !found || filter.latitude < -90 || filter.latitude > 90 {
+			return filter, fmt.Errorf("%w: near %q", errInvalidLibraryFilter, near)
+		}
+		filter.longitude, err = strconv.ParseFloat(strings.TrimSpace(longitude), 64)
+		if err != nil || filter.longitude < -180 || filter.longitude > 180 {
+			return filter, fmt.Errorf("%w: near %q", errInvalidLibraryFilter, near)
+		}
+		filter.near = true
+	}
+	if radius := query.Get("radiusKm"); radius != "" {
+		value, err := strconv.ParseFloat(radius, 64)
+		if err != nil || value <= 0 || !filter.near {
+			return filter, fmt.Errorf("%w: radiusKm %q needs near", errInvalidLibraryFilter, radius)
+		}
+		filter.radiusKm = value
+	}
+	return filter, nil
+}
+
+// distance returns how far a library is from near, false when the library has no coordinates
+func (f libraryFilter) distance(library Library) (float64, bool) {
+	if !f.near || library.Latitude == nil || library.Longitude == nil {
+		return 0, false
+	}
+	return distanceKm(f.latitude, f.longitude, *library.Latitude, *library.Longitude), true
+}
+
+func (f libraryFilter) matches(library Library) bool {
+	if f.country != "" && !strings.EqualFold(f.country, library.Country) {
+		return false
+	}
+	if f.state != "" && !strings.EqualFold(f.state, library.State) {
+		return false
+	}
+	if f.city != "" && !strings.EqualFold(f.city, library.City) {
+		return false
+	}
+	if f.radiusKm > 0 {
+		distance, located := f.distance(library)
+		if !located || distance > f.radiusKm {
+			return false
+		}
+	}
+	return true
+}
+
+// sortLibraries orders libraries by name, or by distance when the filter has
+// near, libraries without coordinates last
+func sortLibraries(libraries []LibraryWithStats) {
+	sort.SliceStable(libraries, func(i, j int) bool {
+		a, b := libraries[i], libraries[j]
+		if (a.DistanceKm == nil) != (b.DistanceKm == nil) {
+			return a.DistanceKm != nil
+		}
+		if a.DistanceKm != nil && *a.DistanceKm != *b.DistanceKm {
+			return *a.DistanceKm < *b.DistanceKm
+		}
+		if nameA, nameB := strings.ToLower(a.Name), strings.ToLower(b.Name); nameA != nameB {
+			return nameA < nameB
+		}
+		return a.Id < b.Id
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// results can be exported as format=csv or format=tsv for spreadsheets, one row
+// per title and library with the counts of that library
+const (
+	exportFormatCSV = "csv"
+	exportFormatTSV = "tsv"
+)
+
+var exportColumns = []string{"id", "title", "subtitle", "creators", "isbns", "formats", "library", "owned", "available", "holds", "waitDays"}
+
+type exportRow struct {
+	result  *SearchResult
+	library *Library
+	counts  *MediaCountResults
+}
+
+// exportable is a response record that flattens into rows
+type exportable interface {
+	exportRows(g *generation) []exportRow
+}
+
+// parseExportFormat returns csv, tsv or "" for the default json
+func parseExportFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		return "", nil
+	case exportFormatCSV, exportFormatTSV:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid format %q", format)
+	}
+}
+
+// newTableWriter sets the headers for a download named name and writes the header row
+func newTableWriter(w http.ResponseWriter, format, name string) (*csv.Writer, error) {
+	table := csv.NewWriter(w)
+	contentType := "text/csv; charset=utf-8"
+	if format == exportFormatTSV {
+		table.Comma = '\t'
+		contentType = "text/tab-separated-values; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	return table, table.Write(exportColumns)
+}
+
+func writeExportRows(table *csv.Writer, rows []exportRow) error {
+	for _, row := range rows {
+		if err := table.Write(row.fields()); err != nil {
+			return err
+		}
+	}
+	table.Flush()
+	return table.Error()
+}
+
+func (row exportRow) fields() []string {
+	creators := make([]string, 0, len(row.result.Creators))
+	for _, creator := range row.result.Creators {
+		creators = append(creators, creator.Name)
+	}
+	fields := []string{
+		strconv.FormatUint(uint64(row.result.Id), 10),
+		row.result.Title,
+		row.result.Subtitle,
+		strings.Join(creators, "; "),
+		strings.Join(row.result.Isbns, "; "),
+		strings.Join(row.result.Formats, "; "),
+		"", "", "", "", "",
+	}
+	if row.library != nil {
+		fields[6] = row.library.Id
+	}
+	if row.counts != nil {
+		fields[5] = strings.Join(row.counts.Formats, "; ")
+		fields[7] = strconv.Itoa(int(row.counts.OwnedCount))
+		fields[8] = strconv.Itoa(int(row.counts.AvailableCount))
+		fields[9] = strconv.Itoa(int(row.counts.HoldsCount))
+		fields[10] = strconv.Itoa(int(row.counts.EstimatedWaitDays))
+	}
+	return fields
+}
+
+func (r *SearchResult) exportRows(g *generation) []exportRow {
+	return []exportRow{{result: r}}
+}
+
+func (d DiffMediaCounts) exportRows(g *generation) []exportRow {
+	return []exportRow{{result: d.SearchResult, library: &d.Library, counts: &d.MediaCountResults}}
+}
+
+func (i IntersectMediaCounts) exportRows(g *generation) []exportRow {
+	return []exportRow{
+		{result: i.SearchResult, library: &i.LeftLibraryMediaCounts.Library, counts: &i.LeftLibraryMediaCounts.MediaCountResults},
+		{result: i.SearchResult, library: &i.RightLibraryMediaCounts.Library, counts: &i.RightLibraryMediaCounts.MediaCountResults},
+	}
+}
+
+func (u UniqueMediaCounts) exportRows(g *generation) []exportRow {
+	counts := g.NewMediaCountResults(u.MediaCounts)
+	return []exportRow{{result: u.SearchResult, library: u.library, counts: &counts}}
+}
+
+func (c CompareMediaCounts) exportRows(g *generation) []exportRow {
+	return libraryExportRows(c.SearchResult, c.Availability)
+}
+
+func (a AvailabilityResponse) exportRows(g *generation) []exportRow {
+	return libraryExportRows(a.SearchResult, a.Availability)
+}
+
+func libraryExportRows(result *SearchResult, availability []LibraryMediaCounts) []exportRow {
+	rows := make([]exportRow, 0, len(availability))
+	for i := range availability {
+		rows = append(rows, exportRow{
+			result:  result,
+			library: &availability[i].Library,
+			counts:  &availability[i].MediaCountResults,
+		})
+	}
+	if len(rows) == 0 {
+		rows = append(rows, exportRow{result: result})
+	}
+	return rows
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// new arrivals are the titles a library started owning, taken from the added
+// side of the change set of every load. they outlive generations and are
+// pruned along with the availability history:
+//
+//	na<libraryId uint16><day uint16><mediaId uint32> -> empty
+//
+// the first load into an empty database isn't recorded, every title would be new
+
+const (
+	atomNamespace = "http://www.w3.org/2005/Atom"
+	// defaultFeedEntries and maxFeedEntries bound the entries of a feed, ?limit= picks in between
+	defaultFeedEntries = 50
+	maxFeedEntries     = 500
+)
+
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []AtomLink  `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+type AtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type AtomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type AtomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type AtomEntry struct {
+	Id      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Authors []AtomAuthor `xml:"author"`
+	Links   []AtomLink   `xml:"link"`
+	Content *AtomText    `xml:"content,omitempty"`
+}
+
+func getNewArrivalKey(libraryIdInt uint16, day uint16, mediaId uint32) []byte {
+	key := make([]byte, 10)
+	key[0] = 'n'
+	key[1] = 'a'
+	binary.BigEndian.PutUint16(key[2:], libraryIdInt)
+	binary.BigEndian.PutUint16(key[4:], day)
+	binary.BigEndian.PutUint32(key[6:], mediaId)
+	return key
+}
+
+func getNewArrivalPrefix(libraryIdInt uint16) []byte {
+	return binary.BigEndian.AppendUint16([]byte("na"), libraryIdInt)
+}
+
+// writeNewArrivals records the added titles of changes as arriving on day
+func writeNewArrivals(changes *AvailabilityChangeSet, day uint16) error {
+	writeBatch := db.NewWriteBatch()
+	count := 0
+	for libraryIdInt, libraryChanges := range changes.Libraries {
+		iter := libraryChanges.Added.Iterator()
+		for iter.HasNext() {
+			if err := writeBatch.Set(getNewArrivalKey(libraryIdInt, day, iter.Next()), []byte{}); err != nil {
+				writeBatch.Cancel()
+				return err
+			}
+			count++
+		}
+	}
+	if err := writeBatch.Flush(); err != nil {
+		return err
+	}
+	log.Info().Int("titles", count).Str("day", dayToDate(day)).Msg("recorded new arrivals")
+	return nil
+}
+
+// newArrival is a title and the day it arrived at a library
+type newArrival struct {
+	mediaId uint32
+	day     uint16
+}
+
+// newArrivals lists the titles a library still owns, newest arrival first. a
+// title that left and came back is listed once, at its latest arrival
+func (g *generation) newArrivals(libraryIdInt uint16, limit int) ([]newArrival, error) {
+	owned := g.libraryBitmap(libraryIdInt)
+	listed := roaring.New()
+	var arrivals []newArrival
+	err := db.View(func(txn *badger.Txn) error {
+		prefix := getNewArrivalPrefix(libraryIdInt)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.PrefetchValues = false
+		opts.Reverse = true
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Seek(append(append([]byte{}, prefix...), 0xff)); iter.Valid() && len(arrivals) < limit; iter.Next() {
+			key := iter.Item().Key()
+			mediaId := binary.BigEndian.Uint32(key[6:])
+			if !owned.Contains(mediaId) || !listed.CheckedAdd(mediaId) {
+				continue
+			}
+			arrivals = append(arrivals, newArrival{mediaId: mediaId, day: binary.BigEndian.Uint16(key[4:])})
+		}
+		return nil
+	})
+	return arrivals, err
+}
+
+// feedBaseUrl is the site the feed is served from, entries link to its pages
+func feedBaseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func parseFeedLimit(r *http.Request) (int, error) {
+	limitParam := r.URL.Query().Get("limit")
+	if limitParam == "" {
+		return defaultFeedEntries, nil
+	}
+	limit, err := strconv.Atoi(limitParam)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("invalid limit %q", limitParam)
+	}
+	return min(limit, maxFeedEntries), nil
+}
+
+func atomTime(day uint16) string {
+	return time.Unix(int64(day)*86400, 0).UTC().Format(time.RFC3339)
+}
+
+// newAtomEntry builds the entry of a title, the description is html from the data source
+func newAtomEntry(baseUrl string, media *Media, updated string) AtomEntry {
+	pageUrl := fmt.Sprintf("%s/availability/%d", baseUrl, media.Id)
+	entry := AtomEntry{
+		Id:      pageUrl,
+		Title:   media.Title,
+		Updated: updated,
+		Links:   []AtomLink{{Href: pageUrl, Rel: "alternate", Type: "text/html"}},
+	}
+	if media.Subtitle != "" {
+		entry.Title += ": " + media.Subtitle
+	}
+	for _, creator := range media.Creators {
+		entry.Authors = append(entry.Authors, AtomAuthor{Name: creator.Name})
+	}
+	// atom requires an author on every entry without a feed level one
+	if len(entry.Authors) == 0 {
+		entry.Authors = []AtomAuthor{{Name: "unknown"}}
+	}
+	var content strings.Builder
+	if media.CoverUrl != "" {
+		fmt.Fprintf(&content, `<p><img src="%s" alt=""/></p>`, xmlEscape(media.CoverUrl))
+		entry.Links = append(entry.Links, AtomLink{Href: media.CoverUrl, Rel: "enclosure", Type: "image/jpeg"})
+	}
+	content.WriteString(media.Description)
+	if content.Len() > 0 {
+		entry.Content = &AtomText{Type: "html", Body: content.String()}
+	}
+	return entry
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	if err := xml.EscapeText(&b, []byte(s)); err != nil {
+		return ""
+	}
+	return b.String()
+}
+
+func writeAtomFeed(w http.ResponseWriter, feed *AtomFeed) {
+	feed.Xmlns = atomNamespace
+	if feed.Entries == nil {
+		feed.Entries = []AtomEntry{}
+	}
+	w.Header().Add("Content-Type", "application/atom+xml; charset=utf-8")
+	_, err := w.Write([]byte(xml.Header))
+	if err == nil {
+		encoder := xml.NewEncoder(w)
+		encoder.Indent("", "  ")
+		err = encoder.Encode(feed)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode atom feed")
+	}
+}
+
+// latestSnapshotTime is when the loaded availability was taken, feeds without
+// dated entries are updated with it
+func latestSnapshotTime() string {
+	days, err := getSnapshotDays()
+	if err != nil || len(days) == 0 {
+		return time.Now().UTC().Format(time.RFC3339)
+	}
+	return atomTime(days[len(days)-1])
+}
+
+func newArrivalsFeedHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	libraryIdInt, library, exists := g.lookupLibrary(r.PathValue("id"))
+	if !exists {
+		http.Error(w, "library not found", http.StatusNotFound)
+		return
+	}
+	limit, err := parseFeedLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	arrivals, err := g.newArrivals(libraryIdInt, limit)
+	if err != nil {
+		log.Error().Err(err).Str("libraryId", library.Id).Msg("failed to read new arrivals")
+		http.Error(w, "failed to read new arrivals", http.StatusInternalServerError)
+		return
+	}
+	baseUrl := feedBaseUrl(r)
+	feed := &AtomFeed{
+		Id:      baseUrl + r.URL.Path,
+		Title:   fmt.Sprintf("New at %s", library.Name),
+		Updated: latestSnapshotTime(),
+		Links:   []AtomLink{{Href: baseUrl + r.URL.RequestURI(), Rel: "self", Type: "application/atom+xml"}},
+	}
+	if len(arrivals) > 0 {
+		feed.Updated = atomTime(arrivals[0].day)
+	}
+	for _, arrival := range arrivals {
+		media, err := g.getMedia(arrival.mediaId)
+		if err != nil {
+			continue
+		}
+		feed.Entries = append(feed.Entries, newAtomEntry(baseUrl, media, atomTime(arrival.day)))
+	}
+	writeAtomFeed(w, feed)
+}
+
+// searchFeedHandler serves the results of a search as a feed, optionally only
+// the titles owned by libraryId
+func searchFeedHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		http.Error(w, "missing q", http.StatusBadRequest)
+		return
+	}
+	limit, err := parseFeedLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	title := fmt.Sprintf("Search for %q", query)
+	var owned *roaring.Bitmap
+	if libraryId := r.URL.Query().Get("libraryId"); libraryId != "" {
+		libraryIdInt, library, exists := g.lookupLibrary(libraryId)
+		if !exists {
+			http.Error(w, "library not found", http.StatusNotFound)
+			return
+		}
+		owned = g.libraryBitmap(libraryIdInt)
+		title += " at " + library.Name
+	}
+	baseUrl := feedBaseUrl(r)
+	updated := latestSnapshotTime()
+	feed := &AtomFeed{
+		Id:      baseUrl + r.URL.RequestURI(),
+		Title:   title,
+		Updated: updated,
+		Links:   []AtomLink{{Href: baseUrl + r.URL.RequestURI(), Rel: "self", Type: "application/atom+xml"}},
+	}
+	for _, id := range g.search.Search(query) {
+		if owned != nil && !owned.Contains(id) {
+			continue
+		}
+		media, err := g.getMedia(id)
+		if err != nil {
+			continue
+		}
+		feed.Entries = append(feed.Entries, newAtomEntry(baseUrl, media, updated))
+		if len(feed.Entries) >= limit {
+			break
+		}
+	}
+	log.Info().Int("results", len(feed.Entries)).Msgf("/feeds/search.atom q: %v", query)
+	writeAtomFeed(w, feed)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a generation is one complete load of libraries, media and availability: the
+// in-memory indexes plus the badger keys under its namespace. reloads build a
+// new generation next to the current one and swap it in, requests that are in
+// flight keep the generation they started with.
+//
+// generation 0 is the keyspace used before generations existed (mk, ma, la, fmt
+// without a prefix), later generations prefix those keys with g<id uint32>.
+// keys that outlive a generation (li, ah, as, cg) are never namespaced and
+// must not start with g.
+type generation struct {
+	id        uint32
+	namespace []byte
+
+	libraryIdMap map[string]uint16
+	libraryMap   map[uint16]Library
+	// consortia maps a member library to its consortia, consortiumMembers the other way around
+	consortia         map[uint16][]uint16
+	consortiumMembers map[uint16][]uint16
+	formatMap         *sync.Map
+	languageMap       *sync.Map
+	search            *SearchIndex
+	// librarySearch indexes library names by their int id
+	librarySearch    *SearchIndex
+	formatStringMap  map[string]uint8
+	formatReverseMap map[uint8]string
+	// libraryBitmaps holds the media ids owned by each library
+	libraryBitmaps map[uint16]*roaring.Bitmap
+	libraryStats   map[uint16]*LibraryStats
+	// visible is the generation seen through the current library rules
+	visible      atomic.Pointer[libraryVisibility]
+	visibleMutex sync.Mutex
+	// historySnapshots is how many availability snapshots the history had after
+	// loading, latestSnapshotDay is the day of the newest
+	historySnapshots  int
+	latestSnapshotDay uint16
+	// velocities caches queueVelocity by velocityKey, the history doesn't change within a generation
+	velocities sync.Map
+	// changes is the diff against the previous load, nil when it wasn't computed
+	changes *AvailabilityChangeSet
+
+	refs        atomic.Int64
+	retired     atomic.Bool
+	drained     chan struct{}
+	drainedOnce sync.Once
+}
+
+type generationContextKey struct{}
+
+var currentGeneration atomic.Pointer[generation]
+
+// reloadMutex makes sure only one generation is built at a time
+var reloadMutex sync.Mutex
+
+func newGeneration(id uint32) *generation {
+	g := &generation{
+		id:                id,
+		libraryIdMap:      map[string]uint16{},
+		libraryMap:        map[uint16]Library{},
+		consortia:         map[uint16][]uint16{},
+		consortiumMembers: map[uint16][]uint16{},
+		formatMap:         &sync.Map{},
+		languageMap:       &sync.Map{},
+		search:            NewSearchIndex(),
+		librarySearch:     NewSearchIndex(),
+		formatStringMap:   map[string]uint8{},
+		formatReverseMap:  map[uint8]string{},
+		libraryBitmaps:    map[uint16]*roaring.Bitmap{},
+		libraryStats:      map[uint16]*LibraryStats{},
+		drained:           make(chan struct{}),
+	}
+	if id != 0 {
+		g.namespace = binary.BigEndian.AppendUint32([]byte("g"), id)
+	}
+	return g
+}
+
+// key prepends the generation namespace to a key
+func (g *generation) key(parts ...[]byte) []byte {
+	size := len(g.namespace)
+	for _, part := range parts {
+		size += len(part)
+	}
+	key := make([]byte, 0, size)
+	key = append(key, g.namespace...)
+	for _, part := range parts {
+		key = append(key, part...)
+	}
+	return key
+}
+
+// trimNamespace strips the generation namespace so key offsets are the same for every generation
+func (g *generation) trimNamespace(key []byte) []byte {
+	return key[len(g.namespace):]
+}
+
+// acquireGeneration returns the current generation and holds a reference to it until release
+func acquireGeneration() *generation {
+	for {
+		g := currentGeneration.Load()
+		g.refs.Add(1)
+		// the generation may have been swapped out between the load and the add
+		if currentGeneration.Load() == g {
+			return g
+		}
+		g.release()
+	}
+}
+
+func (g *generation) release() {
+	if g.refs.Add(-1) == 0 && g.retired.Load() {
+		g.drainedOnce.Do(func() { close(g.drained) })
+	}
+}
+
+func (g *generation) retire() {
+	g.retired.Store(true)
+	if g.refs.Load() == 0 {
+		g.drainedOnce.Do(func() { close(g.drained) })
+	}
+}
+
+// withGeneration pins the current generation for the whole request
+func withGeneration(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g := acquireGeneration()
+		defer g.release()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), generationContextKey{}, g)))
+	})
+}
+
+// requestGeneration is the generation pinned by withGeneration, or the current one
+func requestGeneration(r *http.Request) *generation {
+	if g, ok := r.Context().Value(generationContextKey{}).(*generation); ok {
+		return g
+	}
+	return currentGeneration.Load()
+}
+
+var currentGenerationKey = []byte("cg")
+
+func readCurrentGenerationId() (uint32, error) {
+	var id uint32
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(currentGenerationKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			id = binary.BigEndian.Uint32(val)
+			return nil
+		})
+	})
+	return id, err
+}
+
+func writeCurrentGenerationId(id uint32) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(currentGenerationKey, binary.BigEndian.AppendUint32(nil, id))
+	})
+}
+
+// loadGeneration runs the loaders into g, libraryIds need to be loaded before
+// availability/media. previous is the generation g replaces, if any
+func loadGeneration(g *generation, previous *generation) error {
+	start := time.Now()
+	if err := g.readLibraries(); err != nil {
+		return err
+	}
+	if err := g.readLibraryEnrichment(); err != nil {
+		return err
+	}
+	if err := g.readLibraryPolicies(); err != nil {
+		return err
+	}
+	if err := g.readConsortia(); err != nil {
+		return err
+	}
+	if err := g.readMedia(); err != nil {
+		return err
+	}
+	if err := g.readAvailability(previous); err != nil {
+		return err
+	}
+	if err := g.buildOwnershipBitmaps(); err != nil {
+		return fmt.Errorf("building ownership bitmaps: %w", err)
+	}
+	if err := g.buildLibraryStats(); err != nil {
+		return fmt.Errorf("building library stats: %w", err)
+	}
+	log.Info().Uint32("generation", g.id).Dur("duration", time.Since(start)).Msg("generation loaded")
+	return nil
+}
+
+// reloadGeneration builds a new generation in the background of the running
+// server, swaps it in and drops the old one once its last request finishes
+func reloadGeneration() error {
+	if !reloadMutex.TryLock() {
+		return errReloadInProgress
+	}
+	defer reloadMutex.Unlock()
+	previous := currentGeneration.Load()
+	next := newGeneration(previous.id + 1)
+	log.Info().Uint32("generation", next.id).Msg("building new generation")
+	if err := loadGeneration(next, previous); err != nil {
+		log.Error().Err(err).Uint32("generation", next.id).Msg("failed to build generation, keeping the current one")
+		dropGenerationKeys(next)
+		return err
+	}
+	if err := writeCurrentGenerationId(next.id); err != nil {
+		dropGenerationKeys(next)
+		return fmt.Errorf("persisting generation id: %w", err)
+	}
+	// the change webhooks read next's keys, hold it until they're delivered
+	next.refs.Add(1)
+	currentGeneration.Store(next)
+	previous.retire()
+	go next.precomputeSimilarity()
+	go evaluateWatchlists()
+	go deliverChangeWebhooks(next)
+	go recordSavedQueryCounts()
+	log.Info().Uint32("generation", next.id).Uint32("previous", previous.id).Msg("swapped in new generation")
+	go func() {
+		<-previous.drained
+		dropGenerationKeys(previous)
+	}()
+	return nil
+}
+
+var errReloadInProgress = errors.New("reload already in progress")
+
+// dropGenerationKeys deletes every badger key of a generation that's no longer used
+func dropGenerationKeys(g *generation) {
+	prefixes := [][]byte{g.namespace}
+	if g.id == 0 {
+		prefixes = [][]byte{[]byte("mk"), []byte("ma"), []byte("la"), []byte("fmt")}
+	}
+	start := time.Now()
+	if err := db.DropPrefix(prefixes...); err != nil {
+		log.Error().Err(err).Uint32("generation", g.id).Msg("failed to drop generation")
+		return
+	}
+	log.Info().Uint32("generation", g.id).Dur("duration", time.Since(start)).Msg("dropped generation")
+}
+
+// dropStaleGenerations removes generations left behind by a crash during a
+// reload or before their keys were dropped
+func dropStaleGenerations(current *generation) {
+	var stale [][]byte
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("g")
+		opts.PrefetchValues = false
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); {
+			key := iter.Item().Key()
+			if len(key) < 5 {
+				iter.Next()
+				continue
+			}
+			namespace := append([]byte{}, key[:5]...)
+			if binary.BigEndian.Uint32(namespace[1:]) != current.id {
+				stale = append(stale, namespace)
+			}
+			// skip to the next namespace
+			next := binary.BigEndian.Uint32(namespace[1:]) + 1
+			if next == 0 {
+				break
+			}
+			iter.Seek(binary.BigEndian.AppendUint32([]byte("g"), next))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to look for stale generations")
+		return
+	}
+	if current.id != 0 && hasKeysWithPrefix([]byte("mk")) {
+		dropGenerationKeys(newGeneration(0))
+	}
+	for _, namespace := range stale {
+		dropGenerationKeys(newGeneration(binary.BigEndian.Uint32(namespace[1:])))
+	}
+}
+
+func isAdminRequest(r *http.Request) bool {
+	if cfg.AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
+
+// reloadHandler starts a reload in the background, progress is in the log
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !reloadMutex.TryLock() {
+		http.Error(w, errReloadInProgress.Error(), http.StatusConflict)
+		return
+	}
+	// reloadGeneration takes the lock itself, this only checks nothing is running
+	reloadMutex.Unlock()
+	current := currentGeneration.Load()
+	go func() {
+		if err := reloadGeneration(); err != nil {
+			log.Error().Err(err).Msg("reload failed")
+		}
+	}()
+	log.Info().Msg("/api/admin/reload")
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	err := json.NewEncoder(w).Encode(map[string]uint32{"currentGeneration": current.id})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode reload response")
+	}
+}
+
+func hasKeysWithPrefix(prefix []byte) bool {
+	found := false
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.PrefetchValues = false
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		iter.Rewind()
+		found = iter.Valid()
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to check for keys")
+	}
+	return found
+}
+
+// deleteKeysWithPrefix deletes every key under the prefixes. unlike
+// db.DropPrefix it doesn't block writes, so it's fine for public endpoints
+func deleteKeysWithPrefix(prefixes ...[]byte) error {
+	writeBatch := db.NewWriteBatch()
+	err := db.View(func(txn *badger.Txn) error {
+		for _, prefix := range prefixes {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = prefix
+			opts.PrefetchValues = false
+			iter := txn.NewIterator(opts)
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				if err := writeBatch.Delete(iter.Item().KeyCopy(nil)); err != nil {
+					iter.Close()
+					return err
+				}
+			}
+			iter.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		writeBatch.Cancel()
+		return err
+	}
+	return writeBatch.Flush()
+}
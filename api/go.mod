@@ -15,6 +15,7 @@ require (
 	github.com/marcboeker/go-duckdb v1.8.4
 	github.com/rs/zerolog v1.33.0
 	golang.org/x/text v0.23.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
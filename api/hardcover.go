@@ -7,7 +7,6 @@ import (
 	"github.com/RoaringBitmap/roaring"
 	"github.com/rs/zerolog/log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -32,7 +31,7 @@ type HardcoverBooksResponse struct {
 	} `json:"data"`
 }
 
-func getHardcoverBooksByUsername(username, additionalFilters string) []*SearchResult {
+func getHardcoverBooksByUsername(g *generation, username, additionalFilters string) []*SearchResult {
 	query := `
     query MyQuery($username: citext) {
 	  users(where: {username: {_eq: $username}}) {
@@ -63,7 +62,7 @@ func getHardcoverBooksByUsername(username, additionalFilters string) []*SearchRe
 		return nil
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("HARDCOVER_API_TOKEN")))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", cfg.HardcoverAPIToken))
 
 	client := &http.Client{}
 	start := time.Now()
@@ -99,10 +98,10 @@ func getHardcoverBooksByUsername(username, additionalFilters string) []*SearchRe
 		}
 	}
 
-	return searchMediaByIsbns(isbns, additionalFilters)
+	return searchMediaByIsbns(g, isbns, additionalFilters)
 }
 
-func searchMediaByIsbns(isbns []string, additionalFilters string) []*SearchResult {
+func searchMediaByIsbns(g *generation, isbns []string, additionalFilters string) []*SearchResult {
 	log.Trace().Msgf("Searching media by ISBNs: %v", isbns)
 	bitmap := roaring.NewBitmap()
 	start := time.Now()
@@ -110,7 +109,7 @@ func searchMediaByIsbns(isbns []string, additionalFilters string) []*SearchResul
 		if len(isbn) == 13 && (strings.HasPrefix(isbn, "978") || strings.HasPrefix(isbn, "979")) {
 			isbnInt, err := strconv.ParseUint(isbn, 10, 64)
 			if err == nil {
-				id, exists := search.SearchISBN(isbnInt)
+				id, exists := g.search.SearchISBN(isbnInt)
 				if exists {
 					log.Trace().Msgf("Found media id %d with ISBN: %d", id, isbnInt)
 					bitmap.Add(id)
@@ -127,7 +126,7 @@ func searchMediaByIsbns(isbns []string, additionalFilters string) []*SearchResul
 
 	start = time.Now()
 	if additionalFilters != "" {
-		additionalFiltersBitmap := search.SearchBitmapResult(additionalFilters)
+		additionalFiltersBitmap := g.search.SearchBitmapResult(additionalFilters)
 		duration = time.Since(start)
 		log.Info().Int64("durationNs", duration.Nanoseconds()).
 			Int64("durationMs", duration.Milliseconds()).
@@ -145,9 +144,9 @@ func searchMediaByIsbns(isbns []string, additionalFilters string) []*SearchResul
 	start = time.Now()
 	results := make([]*SearchResult, 0, bitmap.GetCardinality())
 	bitmap.Iterate(func(id uint32) bool {
-		media, err := getMedia(id)
+		media, err := g.getMedia(id)
 		if err == nil {
-			searchResult := NewSearchResult(media)
+			searchResult := g.NewSearchResult(media)
 			results = append(results, searchResult)
 		}
 		return true
@@ -169,7 +168,7 @@ func searchMediaByUsernameHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	results := getHardcoverBooksByUsername(username, additionalFilters)
+	results := getHardcoverBooksByUsername(requestGeneration(r), username, additionalFilters)
 	if results == nil {
 		http.Error(w, "Failed to search media", http.StatusInternalServerError)
 		return
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// availability history is kept outside of the ma/la keys which are overwritten
+// on every load. each load is a snapshot, identified by its day since the unix epoch:
+//
+//	ah<mediaId uint32><libraryId uint16><day uint16> -> owned, available, holds, estimatedWaitDays
+//	as<day uint16> -> number of availability rows in the snapshot
+//
+// a pair only gets an ah point when its counts differ from the previous load,
+// readers carry the last point forward to the later snapshots. an empty value
+// marks the load the library stopped owning the title
+
+const historyDateFormat = "2006-01-02"
+
+type AvailabilityHistoryPoint struct {
+	Date              string `json:"date"`
+	OwnedCount        uint16 `json:"ownedCount"`
+	AvailableCount    uint16 `json:"availableCount"`
+	HoldsCount        uint16 `json:"holdsCount"`
+	EstimatedWaitDays int16  `json:"estimatedWaitDays"`
+}
+
+type LibraryAvailabilityHistory struct {
+	Library Library                    `json:"library"`
+	History []AvailabilityHistoryPoint `json:"history"`
+}
+
+type AvailabilityHistoryResponse struct {
+	*SearchResult
+	Snapshots    []string                     `json:"snapshots"`
+	Availability []LibraryAvailabilityHistory `json:"availability"`
+}
+
+// snapshotDay is the day the current load is stamped with, cfg.SnapshotDate or today (UTC)
+func snapshotDay() (uint16, error) {
+	date := time.Now().UTC()
+	if cfg.SnapshotDate != "" {
+		var err error
+		date, err = time.Parse(historyDateFormat, cfg.SnapshotDate)
+		if err != nil {
+			return 0, fmt.Errorf("invalid snapshot date %q: %w", cfg.SnapshotDate, err)
+		}
+	}
+	return dateToDay(date), nil
+}
+
+func dateToDay(date time.Time) uint16 {
+	return uint16(date.Unix() / 86400)
+}
+
+func dayToDate(day uint16) string {
+	return time.Unix(int64(day)*86400, 0).UTC().Format(historyDateFormat)
+}
+
+func getAvailabilityHistoryKey(mediaId uint32, libraryIdInt uint16, day uint16) []byte {
+	key := make([]byte, 10)
+	key[0] = 'a'
+	key[1] = 'h'
+	binary.BigEndian.PutUint32(key[2:], mediaId)
+	binary.BigEndian.PutUint16(key[6:], libraryIdInt)
+	binary.BigEndian.PutUint16(key[8:], day)
+	return key
+}
+
+func getAvailabilityHistoryPrefix(mediaId uint32) []byte {
+	prefix := make([]byte, 6)
+	prefix[0] = 'a'
+	prefix[1] = 'h'
+	binary.BigEndian.PutUint32(prefix[2:], mediaId)
+	return prefix
+}
+
+func getSnapshotKey(day uint16) []byte {
+	key := make([]byte, 4)
+	key[0] = 'a'
+	key[1] = 's'
+	binary.BigEndian.PutUint16(key[2:], day)
+	return key
+}
+
+// writeAvailabilityHistory adds the counts (without formats) to the snapshot for day
+func writeAvailabilityHistory(writeBatch *badger.WriteBatch, mediaId uint32, libraryIdInt uint16, day uint16, packedBytes []byte) error {
+	return writeBatch.Set(getAvailabilityHistoryKey(mediaId, libraryIdInt, day), packedBytes[:8])
+}
+
+// writeRemovedHistory ends the history of the titles removed in changes on day
+func writeRemovedHistory(writeBatch *badger.WriteBatch, changes *AvailabilityChangeSet, day uint16) error {
+	for libraryIdInt, libraryChanges := range changes.Libraries {
+		iter := libraryChanges.Removed.Iterator()
+		for iter.HasNext() {
+			if err := writeBatch.Set(getAvailabilityHistoryKey(iter.Next(), libraryIdInt, day), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// historyPoint is an ah value of a pair, counts is nil where the library stopped owning the title
+type historyPoint struct {
+	day    uint16
+	counts *MediaCounts
+}
+
+// expandHistory carries the points of a pair forward to a point per snapshot day
+func expandHistory(points []historyPoint, days []uint16) []AvailabilityHistoryPoint {
+	var history []AvailabilityHistoryPoint
+	var current *MediaCounts
+	next := 0
+	for _, day := range days {
+		for next < len(points) && points[next].day <= day {
+			current = points[next].counts
+			next++
+		}
+		if current == nil {
+			continue
+		}
+		history = append(history, AvailabilityHistoryPoint{
+			Date:              dayToDate(day),
+			OwnedCount:        current.OwnedCount,
+			AvailableCount:    current.AvailableCount,
+			HoldsCount:        current.HoldsCount,
+			EstimatedWaitDays: current.EstimatedWaitDays,
+		})
+	}
+	return history
+}
+
+func writeSnapshot(day uint16, count int) error {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(count))
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(getSnapshotKey(day), value)
+	})
+}
+
+func getSnapshotDays() ([]uint16, error) {
+	var days []uint16
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("as")
+		opts.PrefetchValues = false
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			days = append(days, binary.BigEndian.Uint16(iter.Item().Key()[2:]))
+		}
+		return nil
+	})
+	return days, err
+}
+
+// pruneAvailabilityHistory deletes snapshots, new arrivals, saved query counts and webhook deliveries older than cfg.HistoryRetentionDays
+// (relative to the latest snapshot). zero keeps everything
+func pruneAvailabilityHistory(latestDay uint16) error {
+	if cfg.HistoryRetentionDays <= 0 || int(latestDay) <= cfg.HistoryRetentionDays {
+		return nil
+	}
+	cutoff := latestDay - uint16(cfg.HistoryRetentionDays)
+	writeBatch := db.NewWriteBatch()
+	deleted := 0
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		deleted, err = pruneHistoryPoints(txn, writeBatch, cutoff)
+		if err != nil {
+			return err
+		}
+		for _, prefix := range [][]byte{[]byte("as"), []byte("na"), []byte("sc"), []byte("hd")} {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = prefix
+			opts.PrefetchValues = false
+			iter := txn.NewIterator(opts)
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				key := iter.Item().Key()
+				// history keys end with the day, new arrivals have it after the library id
+				// and webhook deliveries end with the time they were made
+				day := binary.BigEndian.Uint16(key[len(key)-2:])
+				switch prefix[0] {
+				case 'n':
+					day = binary.BigEndian.Uint16(key[4:])
+				case 'h':
+					day = uint16(binary.BigEndian.Uint64(key[len(key)-8:]) / uint64(24*time.Hour))
+				}
+				if day >= cutoff {
+					continue
+				}
+				if err := writeBatch.Delete(iter.Item().KeyCopy(nil)); err != nil {
+					iter.Close()
+					return err
+				}
+				deleted++
+			}
+			iter.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		writeBatch.Cancel()
+		return err
+	}
+	if err := writeBatch.Flush(); err != nil {
+		return err
+	}
+	log.Info().Int("deleted", deleted).Str("cutoff", dayToDate(cutoff)).Msg("pruned availability history")
+	return nil
+}
+
+// pruneHistoryPoints deletes the ah points older than cutoff. the newest older
+// point of a pair still holds its counts at the cutoff, so it's kept unless
+// it's a removal
+func pruneHistoryPoints(txn *badger.Txn, writeBatch *badger.WriteBatch, cutoff uint16) (int, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte("ah")
+	opts.PrefetchValues = false
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+	deleted := 0
+	// kept is the newest point before the cutoff of the current pair
+	var kept []byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		key := item.Key()
+		if kept != nil && !bytes.Equal(kept[:8], key[:8]) {
+			kept = nil
+		}
+		if binary.BigEndian.Uint16(key[8:]) >= cutoff {
+			continue
+		}
+		if kept != nil {
+			if err := writeBatch.Delete(kept); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+		kept = item.KeyCopy(nil)
+		removal := false
+		err := item.Value(func(val []byte) error {
+			removal = len(val) == 0
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+		if removal {
+			if err := writeBatch.Delete(kept); err != nil {
+				return deleted, err
+			}
+			deleted++
+			kept = nil
+		}
+	}
+	return deleted, nil
+}
+
+func availabilityHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	// libraryId is optional, without it every library that ever owned the title is returned
+	var libraryIdInt uint16
+	libraryId := r.URL.Query().Get("libraryId")
+	if libraryId != "" {
+		var exists bool
+		libraryIdInt, exists = g.libraryIdMap[libraryId]
+		if !exists {
+			http.Error(w, "invalid library id", http.StatusBadRequest)
+			return
+		}
+	}
+	media, err := g.getMedia(uint32(id))
+	if err != nil {
+		http.Error(w, "media not found", http.StatusNotFound)
+		return
+	}
+	log.Info().Msgf("/api/availability/history id: %d libraryId: %s", id, libraryId)
+	prefix := getAvailabilityHistoryPrefix(uint32(id))
+	if libraryId != "" {
+		prefix = binary.BigEndian.AppendUint16(prefix, libraryIdInt)
+	}
+	days, err := getSnapshotDays()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read snapshots")
+		http.Error(w, "failed to read availability history", http.StatusInternalServerError)
+		return
+	}
+	var results []LibraryAvailabilityHistory
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		var library Library
+		var points []historyPoint
+		// addLibrary expands the points of the library read so far
+		addLibrary := func() {
+			if history := expandHistory(points, days); len(history) > 0 {
+				results = append(results, LibraryAvailabilityHistory{Library: library, History: history})
+			}
+			points = nil
+		}
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			key := item.Key()
+			rowLibrary, exists := g.library(binary.BigEndian.Uint16(key[6:]))
+			if !exists {
+				continue
+			}
+			if len(points) > 0 && library.Id != rowLibrary.Id {
+				addLibrary()
+			}
+			library = rowLibrary
+			point := historyPoint{day: binary.BigEndian.Uint16(key[8:])}
+			err := item.Value(func(val []byte) error {
+				if len(val) == 0 {
+					return nil
+				}
+				var err error
+				point.counts, err = decodeMediaCounts(val)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			points = append(points, point)
+		}
+		if len(points) > 0 {
+			addLibrary()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read availability history")
+		http.Error(w, "failed to read availability history", http.StatusInternalServerError)
+		return
+	}
+	snapshots := make([]string, 0, len(days))
+	for _, day := range days {
+		snapshots = append(snapshots, dayToDate(day))
+	}
+	if results == nil {
+		results = []LibraryAvailabilityHistory{}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(AvailabilityHistoryResponse{
+		SearchResult: g.NewSearchResult(media),
+		Snapshots:    snapshots,
+		Availability: results,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode availability history")
+	}
+}
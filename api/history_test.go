@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/dgraph-io/badger/v4"
+	"reflect"
+	"testing"
+)
+
+// openTestDB points db at an in-memory badger for the test
+func openTestDB(t *testing.T) {
+	t.Helper()
+	testDB, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		testDB.Close()
+		db = previous
+	})
+}
+
+func historyCounts(owned, available, holds uint16) *MediaCounts {
+	return &MediaCounts{OwnedCount: owned, AvailableCount: available, HoldsCount: holds}
+}
+
+func TestExpandHistory(t *testing.T) {
+	days := []uint16{10, 11, 12, 13, 14}
+	tests := []struct {
+		name   string
+		points []historyPoint
+		want   []uint16
+		holds  []uint16
+	}{
+		{
+			name:   "carried forward",
+			points: []historyPoint{{day: 10, counts: historyCounts(1, 0, 3)}, {day: 12, counts: historyCounts(1, 0, 1)}},
+			want:   []uint16{10, 11, 12, 13, 14},
+			holds:  []uint16{3, 3, 1, 1, 1},
+		},
+		{
+			name:   "point before the first snapshot",
+			points: []historyPoint{{day: 5, counts: historyCounts(2, 0, 4)}},
+			want:   []uint16{10, 11, 12, 13, 14},
+			holds:  []uint16{4, 4, 4, 4, 4},
+		},
+		{
+			name:   "removed and added back",
+			points: []historyPoint{{day: 10, counts: historyCounts(1, 0, 2)}, {day: 12}, {day: 14, counts: historyCounts(1, 1, 0)}},
+			want:   []uint16{10, 11, 14},
+			holds:  []uint16{2, 2, 0},
+		},
+		{
+			name:   "added after the first snapshot",
+			points: []historyPoint{{day: 13, counts: historyCounts(1, 1, 0)}},
+			want:   []uint16{13, 14},
+			holds:  []uint16{0, 0},
+		},
+		{
+			name:   "removed before every snapshot",
+			points: []historyPoint{{day: 5, counts: historyCounts(1, 1, 0)}, {day: 8}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			history := expandHistory(test.points, days)
+			var got, want []AvailabilityHistoryPoint
+			for _, point := range history {
+				got = append(got, AvailabilityHistoryPoint{Date: point.Date, HoldsCount: point.HoldsCount})
+			}
+			for i, day := range test.want {
+				want = append(want, AvailabilityHistoryPoint{Date: dayToDate(day), HoldsCount: test.holds[i]})
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expandHistory = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestPruneHistoryPoints(t *testing.T) {
+	openTestDB(t)
+	points := []struct {
+		mediaId uint32
+		day     uint16
+		removed bool
+	}{
+		// unchanged since before the cutoff, the newest older point is kept
+		{1, 10, false}, {1, 15, false}, {1, 25, false},
+		// only points before the cutoff
+		{2, 10, false}, {2, 12, false},
+		// removed before the cutoff
+		{3, 10, false}, {3, 15, true},
+		// removed and added back before the cutoff
+		{4, 10, false}, {4, 12, true}, {4, 14, false},
+		// only points after the cutoff
+		{5, 20, false}, {5, 22, false},
+	}
+	err := db.Update(func(txn *badger.Txn) error {
+		for _, point := range points {
+			value := encodeMediaCounts(historyCounts(1, 0, 0))
+			if point.removed {
+				value = []byte{}
+			}
+			if err := txn.Set(getAvailabilityHistoryKey(point.mediaId, 1, point.day), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeBatch := db.NewWriteBatch()
+	err = db.View(func(txn *badger.Txn) error {
+		_, err := pruneHistoryPoints(txn, writeBatch, 20)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeBatch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	remaining := map[uint32][]uint16{}
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("ah")
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			key := iter.Item().Key()
+			mediaId := binary.BigEndian.Uint32(key[2:])
+			remaining[mediaId] = append(remaining[mediaId], binary.BigEndian.Uint16(key[8:]))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32][]uint16{
+		1: {15, 25},
+		2: {12},
+		4: {14},
+		5: {20, 22},
+	}
+	if !reflect.DeepEqual(remaining, want) {
+		t.Errorf("remaining points = %v, want %v", remaining, want)
+	}
+}
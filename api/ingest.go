@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const defaultIngestErrorBudget = 0.01
+
+// ingestReport tracks accepted and rejected rows for one loader. rejected rows
+// are written with their line number and reason to <quarantineDir>/<name>.quarantine.csv
+type ingestReport struct {
+	name           string
+	accepted       int
+	rejected       int
+	errorBudget    float64
+	quarantinePath string
+	quarantineFile *os.File
+	quarantine     *csv.Writer
+}
+
+func newIngestReport(name string) *ingestReport {
+	return &ingestReport{
+		name:           name,
+		errorBudget:    cfg.IngestErrorBudget,
+		quarantinePath: filepath.Join(cfg.QuarantineDir, name+".quarantine.csv"),
+	}
+}
+
+func (r *ingestReport) accept() {
+	r.accepted++
+}
+
+// reject records a bad row. the quarantine file is only created once the first
+// row is rejected so clean loads don't leave empty files behind
+func (r *ingestReport) reject(line int, reason string, record []string) {
+	r.rejected++
+	log.Debug().Str("loader", r.name).Int("line", line).Str("reason", reason).Msg("rejected row")
+	if r.quarantine == nil {
+		err := os.MkdirAll(filepath.Dir(r.quarantinePath), 0755)
+		if err != nil {
+			log.Error().Err(err).Str("path", r.quarantinePath).Msg("failed to create quarantine dir")
+			return
+		}
+		r.quarantineFile, err = os.Create(r.quarantinePath)
+		if err != nil {
+			log.Error().Err(err).Str("path", r.quarantinePath).Msg("failed to create quarantine file")
+			return
+		}
+		r.quarantine = csv.NewWriter(r.quarantineFile)
+		err = r.quarantine.Write([]string{"line", "reason", "fields"})
+		if err != nil {
+			log.Error().Err(err).Str("path", r.quarantinePath).Msg("failed to write quarantine header")
+		}
+	}
+	err := r.quarantine.Write(append([]string{strconv.Itoa(line), reason}, record...))
+	if err != nil {
+		log.Error().Err(err).Str("path", r.quarantinePath).Msg("failed to write quarantine row")
+	}
+}
+
+// readRow reads the next csv row and returns the line it started on. malformed
+// csv is rejected here so the loaders only ever see rows they can validate
+func (r *ingestReport) readRow(cr *csv.Reader) ([]string, int, error) {
+	for {
+		record, err := cr.Read()
+		if err == nil {
+			line, _ := cr.FieldPos(0)
+			return record, line, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			r.reject(parseErr.StartLine, parseErr.Err.Error(), record)
+			continue
+		}
+		return nil, 0, err
+	}
+}
+
+// finish logs the summary, closes the quarantine file and returns an error
+// when the share of rejected rows is over the error budget
+func (r *ingestReport) finish() error {
+	if r.quarantine != nil {
+		r.quarantine.Flush()
+		if err := r.quarantine.Error(); err != nil {
+			log.Error().Err(err).Str("path", r.quarantinePath).Msg("failed to flush quarantine file")
+		}
+		r.quarantineFile.Close()
+	}
+	total := r.accepted + r.rejected
+	event := log.Info()
+	if r.rejected > 0 {
+		event = log.Warn().Str("quarantine", r.quarantinePath)
+	}
+	event.Str("loader", r.name).
+		Int("accepted", r.accepted).
+		Int("rejected", r.rejected).
+		Msg("ingest summary")
+	if total > 0 && float64(r.rejected)/float64(total) > r.errorBudget {
+		return fmt.Errorf("%s: rejected %d of %d rows, over error budget of %.2f%%",
+			r.name, r.rejected, total, r.errorBudget*100)
+	}
+	return nil
+}
+
+// newCSVReader returns a reader that leaves field count checks to the loaders
+func newCSVReader(r io.Reader) *csv.Reader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	return cr
+}
+
+func checkFieldCount(record []string, expected int) error {
+	if len(record) != expected {
+		return fmt.Errorf("expected %d fields, got %d", expected, len(record))
+	}
+	return nil
+}
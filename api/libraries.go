@@ -1,17 +1,17 @@
 package main
 
 import (
-	"compress/gzip"
-	"context"
-	"encoding/csv"
+	"encoding/binary"
 	"encoding/json"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"fmt"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dgraph-io/badger/v4"
 	"github.com/rs/zerolog/log"
 	"io"
+	"math"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 )
 
 type Library struct {
@@ -19,88 +19,176 @@ type Library struct {
 	WebsiteId    int    `json:"websiteId"`
 	Name         string `json:"name"`
 	IsConsortium bool   `json:"isConsortium"`
+	// Kind and Region are set by the library rules
+	Kind   string `json:"kind,omitempty"`
+	Region string `json:"region,omitempty"`
+	// the location and homepage come from libraries-enrichment.csv.gz
+	Country   string   `json:"country,omitempty"`
+	State     string   `json:"state,omitempty"`
+	City      string   `json:"city,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	Homepage  string   `json:"homepage,omitempty"`
+	// Policy comes from library-policies.csv.gz, nil when the library has none
+	Policy *LibraryPolicy `json:"policy,omitempty"`
 }
 
 type LibraryResponse struct {
-	Libraries []Library `json:"libraries"`
+	Libraries []LibraryWithStats `json:"libraries"`
 }
 
-var libraryIdMap map[string]uint16
-var libraryMap map[uint16]Library
+// LibraryWithStats only has stats when they were asked for with withStats=true,
+// and a distance when libraries were searched near a location
+type LibraryWithStats struct {
+	Library
+	DistanceKm *float64      `json:"distanceKm,omitempty"`
+	Stats      *LibraryStats `json:"stats,omitempty"`
+}
 
-func readLibraries() {
-	libraryMap = make(map[uint16]Library)
-	libraryIdMap = make(map[string]uint16)
-	var gzr *gzip.Reader
-	if os.Getenv("LOCAL_TESTING") == "true" {
-		f, err := os.Open("../../librarylibrary/libraries.csv.gz")
-		defer f.Close()
-		if err != nil {
-			log.Error().Err(err)
-		}
-		gzr, err = gzip.NewReader(f)
-		if err != nil {
-			log.Error().Err(err)
-		}
-	} else {
-		s3Path := "libraries.csv.gz"
-		if s3Client == nil {
-			getS3Client()
-		}
-		resp, err := s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-			Bucket: aws.String("deep-libby"),
-			Key:    aws.String(s3Path),
-		})
-		if err != nil {
-			log.Error().Err(err)
-		}
-		defer resp.Body.Close()
-		gzr, err = gzip.NewReader(resp.Body)
-		if err != nil {
-			log.Error().Err(err)
-		}
+func (g *generation) readLibraries() error {
+	cr, closer, err := openGzipCSV(dataSource, "libraries.csv.gz")
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	// library ids are persisted so keys written by earlier loads (history in particular)
+	// keep pointing at the same library when libraries.csv changes order
+	persistedIds, err := readLibraryIds()
+	if err != nil {
+		return fmt.Errorf("reading library ids: %w", err)
+	}
+	nextId := 0
+	for _, libraryIdInt := range persistedIds {
+		nextId = max(nextId, int(libraryIdInt)+1)
 	}
-	cr := csv.NewReader(gzr)
+	writeBatch := db.NewWriteBatch()
+	report := newIngestReport("libraries")
 	for {
-		record, err := cr.Read()
+		record, line, err := report.readRow(cr)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Error().Err(err)
+			writeBatch.Cancel()
+			return fmt.Errorf("reading libraries: %w", err)
 		}
-		websiteId, err := strconv.Atoi(record[1])
+		library, err := parseLibraryRecord(record)
 		if err != nil {
-			log.Error().Err(err)
+			report.reject(line, err.Error(), record)
+			continue
 		}
-		libraryId := record[0]
-		libraryIdInt, exists := libraryIdMap[libraryId]
+		libraryIdInt, exists := persistedIds[library.Id]
 		if !exists {
-			libraryIdInt = uint16(len(libraryIdMap))
-			libraryIdMap[libraryId] = libraryIdInt
-		}
-		libraryMap[libraryIdInt] = Library{
-			Id:           record[0],
-			WebsiteId:    websiteId,
-			Name:         record[2],
-			IsConsortium: record[3] == "true",
+			if nextId > math.MaxUint16 {
+				report.reject(line, "out of library ids", record)
+				continue
+			}
+			libraryIdInt = uint16(nextId)
+			nextId++
+			persistedIds[library.Id] = libraryIdInt
+			err = writeBatch.Set(getLibraryIdKey(library.Id), binary.BigEndian.AppendUint16(nil, libraryIdInt))
+			if err != nil {
+				log.Error().Err(err).Msg("failed to write library id")
+			}
 		}
+		g.libraryIdMap[library.Id] = libraryIdInt
+		g.libraryMap[libraryIdInt] = library
+		report.accept()
+	}
+	err = writeBatch.Flush()
+	if err != nil {
+		return fmt.Errorf("writing library ids: %w", err)
 	}
-	gzr.Close()
 	log.Info().Msg("done reading libraries")
+	return report.finish()
+}
+
+func getLibraryIdKey(libraryId string) []byte {
+	return append([]byte("li"), []byte(libraryId)...)
+}
+
+func readLibraryIds() (map[string]uint16, error) {
+	libraryIds := map[string]uint16{}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("li")
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			err := item.Value(func(val []byte) error {
+				libraryIds[string(item.Key()[2:])] = binary.BigEndian.Uint16(val)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return libraryIds, err
+}
+
+// parseLibraryRecord validates a libraries.csv row:
+// id, websiteId, name, isConsortium
+func parseLibraryRecord(record []string) (Library, error) {
+	if err := checkFieldCount(record, 4); err != nil {
+		return Library{}, err
+	}
+	if record[0] == "" {
+		return Library{}, fmt.Errorf("empty library id")
+	}
+	websiteId, err := strconv.Atoi(record[1])
+	if err != nil {
+		return Library{}, fmt.Errorf("invalid websiteId %q", record[1])
+	}
+	if record[3] != "true" && record[3] != "false" {
+		return Library{}, fmt.Errorf("invalid isConsortium %q", record[3])
+	}
+	return Library{
+		Id:           record[0],
+		WebsiteId:    websiteId,
+		Name:         record[2],
+		IsConsortium: record[3] == "true",
+	}, nil
 }
 
 func librariesHandler(w http.ResponseWriter, r *http.Request) {
-	log.Info().Msg("/api/libraries")
-	if libraryMap == nil {
-		readLibraries()
+	g := requestGeneration(r)
+	query := r.URL.Query().Get("q")
+	log.Info().Msgf("/api/libraries q: %s", query)
+	withStats := r.URL.Query().Get("withStats") == "true"
+	filter, err := parseLibraryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var matching *roaring.Bitmap
+	if strings.TrimSpace(query) != "" {
+		matching = g.searchLibraries(query)
 	}
-	libraries := make([]Library, 0, len(libraryMap))
-	for _, library := range libraryMap {
-		libraries = append(libraries, library)
+	visible := g.visibility().libraries
+	libraries := make([]LibraryWithStats, 0, len(visible))
+	for libraryIdInt, library := range visible {
+		if matching != nil && !matching.Contains(uint32(libraryIdInt)) {
+			continue
+		}
+		if !filter.matches(library) {
+			continue
+		}
+		libraryWithStats := LibraryWithStats{Library: library}
+		if distance, located := filter.distance(library); located {
+			libraryWithStats.DistanceKm = &distance
+		}
+		if withStats {
+			libraryWithStats.Stats = g.getLibraryStats(libraryIdInt)
+		}
+		libraries = append(libraries, libraryWithStats)
 	}
-	err := json.NewEncoder(w).Encode(LibraryResponse{libraries})
+	sortLibraries(libraries)
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(LibraryResponse{libraries})
 	if err != nil {
-		log.Error().Err(err)
+		log.Error().Err(err).Msg("failed to encode libraries")
 	}
 }
@@ -5,7 +5,6 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/gob"
-	"fmt"
 	"github.com/NYTimes/gziphandler"
 	"github.com/allegro/bigcache"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -34,8 +33,6 @@ type UiStatic struct {
 var uiCache *bigcache.BigCache
 var s3Client *s3.Client
 
-const port = "443"
-
 var dataLoaded = false
 var db *badger.DB
 
@@ -43,7 +40,18 @@ func main() {
 	var err error
 	stdlog.SetFlags(0)
 	stdlog.SetOutput(log.Logger)
-	badgerOpts := badger.DefaultOptions("deeplibby.badger").
+	var printConfig bool
+	cfg, printConfig, err = loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid config")
+	}
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal().Err(err).Msg("failed to print config")
+		}
+		os.Exit(0)
+	}
+	badgerOpts := badger.DefaultOptions(cfg.BadgerDir).
 		WithLogger(nil)
 	db, err = badger.Open(badgerOpts)
 	if err != nil {
@@ -57,13 +65,9 @@ func main() {
 			fmt.Println(http.ListenAndServe("localhost:6060", nil))
 		}()
 	*/
-	if os.Getenv("LOCAL_TESTING") == "true" {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "15:04:05.000"})
-		log.Logger = log.Level(zerolog.DebugLevel)
-	} else {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "15:04:05.000", NoColor: true})
-		log.Logger = log.Level(zerolog.InfoLevel)
-	}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "15:04:05.000", NoColor: !cfg.LocalTesting})
+	logLevel, _ := zerolog.ParseLevel(cfg.LogLevel)
+	log.Logger = log.Level(logLevel)
 
 	// handle graceful shutdown on SIGINT and SIGTERM
 	c := make(chan os.Signal, 1)
@@ -77,17 +81,58 @@ func main() {
 	}()
 
 	zerolog.TimeFieldFormat = time.RFC3339Nano
-	log.Info().Msg("reading initial data")
-	// this one is fast and libraryIds need to be loaded before availability/media
-	readLibraries()
-	if os.Getenv("LOAD_ONLY") == "true" {
-		readMedia()
-		readAvailability()
+	dataSource, err = NewDataSource(cfg.DataSource)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to configure data source")
+	}
+	if err := loadLibraryRules(); err != nil {
+		log.Fatal().Err(err).Msg("failed to load library rules")
+	}
+	log.Info().Str("dataSource", dataSource.String()).Msg("reading initial data")
+	generationId, err := readCurrentGenerationId()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to read current generation")
+	}
+	g := newGeneration(generationId)
+	if err := loadGeneration(g, nil); err != nil {
+		log.Fatal().Err(err).Msg("failed to load data")
+	}
+	currentGeneration.Store(g)
+	dropStaleGenerations(g)
+	go g.precomputeSimilarity()
+	if cfg.LoadOnly {
+		evaluateWatchlists()
+		g.refs.Add(1)
+		deliverChangeWebhooks(g)
+		recordSavedQueryCounts()
 		log.Info().Msg("shutting down")
 		os.Exit(0)
 	}
-	readMedia()
-	readAvailability()
+	go evaluateWatchlists()
+	g.refs.Add(1)
+	go deliverChangeWebhooks(g)
+	go recordSavedQueryCounts()
+
+	// SIGHUP (and the optional interval) reload the data source into a new generation
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		var tick <-chan time.Time
+		if cfg.ReloadInterval > 0 {
+			tick = time.NewTicker(cfg.ReloadInterval).C
+		}
+		for {
+			select {
+			case <-hup:
+				log.Info().Msg("reloading on SIGHUP")
+			case <-tick:
+				log.Info().Msg("reloading on interval")
+			}
+			if err := reloadGeneration(); err != nil {
+				log.Error().Err(err).Msg("reload failed")
+			}
+		}
+	}()
 
 	rootServeMux := http.NewServeMux()
 	uiServeMux := http.NewServeMux()
@@ -96,19 +141,46 @@ func main() {
 	apiServeMux := http.NewServeMux()
 	apiServeMux.Handle("GET /api/search", gziphandler.GzipHandler(http.HandlerFunc(searchHandler)))
 	apiServeMux.Handle("GET /api/libraries", gziphandler.GzipHandler(http.HandlerFunc(librariesHandler)))
+	apiServeMux.Handle("GET /api/library/stats", gziphandler.GzipHandler(http.HandlerFunc(libraryStatsHandler)))
+	apiServeMux.Handle("GET /api/library/similar", gziphandler.GzipHandler(http.HandlerFunc(similarLibrariesHandler)))
+	apiServeMux.Handle("GET /api/library/demand", gziphandler.GzipHandler(http.HandlerFunc(libraryDemandHandler)))
+	apiServeMux.Handle("GET /api/overlap", gziphandler.GzipHandler(http.HandlerFunc(overlapHandler)))
+	apiServeMux.Handle("GET /api/recommend-library", gziphandler.GzipHandler(http.HandlerFunc(recommendLibraryHandler)))
 	apiServeMux.Handle("GET /api/availability", gziphandler.GzipHandler(http.HandlerFunc(availabilityHandler)))
+	apiServeMux.Handle("POST /api/availability/batch", gziphandler.GzipHandler(http.HandlerFunc(batchAvailabilityHandler)))
+	apiServeMux.Handle("POST /api/plan-holds", gziphandler.GzipHandler(http.HandlerFunc(planHoldsHandler)))
+	apiServeMux.Handle("GET /api/availability/history", gziphandler.GzipHandler(http.HandlerFunc(availabilityHistoryHandler)))
 	apiServeMux.Handle("GET /api/diff", gziphandler.GzipHandler(http.HandlerFunc(diffHandler)))
 	apiServeMux.Handle("GET /api/intersect", gziphandler.GzipHandler(http.HandlerFunc(intersectHandler)))
 	apiServeMux.Handle("GET /api/unique", gziphandler.GzipHandler(http.HandlerFunc(uniqueHandler)))
+	apiServeMux.Handle("GET /api/compare", gziphandler.GzipHandler(http.HandlerFunc(compareHandler)))
 	apiServeMux.Handle("GET /api/memory", gziphandler.GzipHandler(http.HandlerFunc(memoryHandler)))
 	apiServeMux.Handle("GET /api/search-debug", gziphandler.GzipHandler(http.HandlerFunc(searchDebugHandler)))
 	apiServeMux.Handle("GET /api/search-hardcover", gziphandler.GzipHandler(http.HandlerFunc(searchMediaByUsernameHandler)))
+	apiServeMux.Handle("POST /api/watchlist", http.HandlerFunc(saveWatchlistHandler))
+	apiServeMux.Handle("PUT /api/watchlist", http.HandlerFunc(saveWatchlistHandler))
+	apiServeMux.Handle("GET /api/watchlist", http.HandlerFunc(getWatchlistHandler))
+	apiServeMux.Handle("DELETE /api/watchlist", http.HandlerFunc(deleteWatchlistHandler))
+	apiServeMux.Handle("GET /api/watchlist/confirm", http.HandlerFunc(confirmWatchlistEmailHandler))
+	apiServeMux.Handle("GET /api/watchlist/alerts", gziphandler.GzipHandler(http.HandlerFunc(watchlistAlertsHandler)))
+	apiServeMux.Handle("POST /api/saved", http.HandlerFunc(createSavedQueryHandler))
+	apiServeMux.Handle("GET /api/saved", http.HandlerFunc(getSavedQueryHandler))
+	apiServeMux.Handle("DELETE /api/saved", http.HandlerFunc(deleteSavedQueryHandler))
+	apiServeMux.Handle("GET /api/saved/run", gziphandler.GzipHandler(http.HandlerFunc(runSavedQueryHandler)))
+	apiServeMux.Handle("POST /api/admin/reload", http.HandlerFunc(reloadHandler))
+	apiServeMux.Handle("GET /api/admin/library-rules", http.HandlerFunc(libraryRulesHandler))
+	apiServeMux.Handle("PUT /api/admin/library-rules", http.HandlerFunc(libraryRulesHandler))
+	apiServeMux.Handle("GET /api/admin/webhooks", http.HandlerFunc(webhookSubscriptionsHandler))
+	apiServeMux.Handle("POST /api/admin/webhooks", http.HandlerFunc(createWebhookSubscriptionHandler))
+	apiServeMux.Handle("DELETE /api/admin/webhooks", http.HandlerFunc(deleteWebhookSubscriptionHandler))
+	apiServeMux.Handle("GET /api/admin/webhooks/deliveries", gziphandler.GzipHandler(http.HandlerFunc(webhookDeliveriesHandler)))
 
 	corsAPIMux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Set CORS headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count")
 
 		// If it's a preflight request, respond immediately
 		if r.Method == "OPTIONS" {
@@ -116,27 +188,25 @@ func main() {
 		}
 
 		// Otherwise, pass the request on to the original ServeMux
-		apiServeMux.ServeHTTP(w, r)
+		withGeneration(apiServeMux).ServeHTTP(w, r)
 	})
 
+	feedServeMux := http.NewServeMux()
+	feedServeMux.Handle("GET /feeds/library/{id}/new.atom", gziphandler.GzipHandler(http.HandlerFunc(newArrivalsFeedHandler)))
+	feedServeMux.Handle("GET /feeds/search.atom", gziphandler.GzipHandler(http.HandlerFunc(searchFeedHandler)))
+
 	rootServeMux.Handle("/", uiServeMux)
 	rootServeMux.Handle("/api/", corsAPIMux)
+	rootServeMux.Handle("/feeds/", withGeneration(feedServeMux))
 
-	if os.Getenv("LOCAL_TESTING") == "true" {
-		port := "8080"
-		log.Info().Str("port", port).Msg("starting server")
-		err := http.ListenAndServe(fmt.Sprintf("localhost:%s", port), rootServeMux)
-		if err != nil {
-			log.Fatal().Err(err)
-		}
+	log.Info().Str("addr", cfg.ListenAddr()).Bool("tls", cfg.TLSCertFile != "").Msg("starting server")
+	if cfg.TLSCertFile == "" {
+		err = http.ListenAndServe(cfg.ListenAddr(), rootServeMux)
 	} else {
-		log.Info().Str("port", port).Msg("starting server")
-		privKey := "/etc/letsencrypt/live/deeplibby.com/privkey.pem"
-		certFile := "/etc/letsencrypt/live/deeplibby.com/fullchain.pem"
-		err := http.ListenAndServeTLS(fmt.Sprintf("0.0.0.0:%s", port), certFile, privKey, rootServeMux)
-		if err != nil {
-			log.Fatal().Err(err)
-		}
+		err = http.ListenAndServeTLS(cfg.ListenAddr(), cfg.TLSCertFile, cfg.TLSKeyFile, rootServeMux)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("server stopped")
 	}
 }
 
@@ -149,9 +219,10 @@ func calculateMemoryUsage(v interface{}) int {
 }
 
 func memoryHandler(writer http.ResponseWriter, request *http.Request) {
-	log.Info().Msgf("Memory usage of libraryMap: %d bytes\n", calculateMemoryUsage(libraryMap))
+	g := requestGeneration(request)
+	log.Info().Msgf("Memory usage of libraryMap: %d bytes\n", calculateMemoryUsage(g.libraryMap))
 	sum := uint64(0)
-	formatMap.Range(func(key, value interface{}) bool {
+	g.formatMap.Range(func(key, value interface{}) bool {
 		size := value.(*ConcurrentBitmap).UnsafeBitmap().GetSizeInBytes()
 		if size > 1024*1024 {
 			log.Info().Msgf("memory usage of formatMap[%s]: %d bytes\n", key, size)
@@ -161,7 +232,7 @@ func memoryHandler(writer http.ResponseWriter, request *http.Request) {
 	})
 	log.Info().Msgf("Memory usage of formatMap values: %d bytes\n", sum)
 	sum = 0
-	languageMap.Range(func(key, value interface{}) bool {
+	g.languageMap.Range(func(key, value interface{}) bool {
 		size := value.(*ConcurrentBitmap).UnsafeBitmap().GetSizeInBytes()
 		if size > 128*1024 {
 			log.Info().Msgf("memory usage of languageMap[%s]: %d bytes\n", key, size)
@@ -171,19 +242,18 @@ func memoryHandler(writer http.ResponseWriter, request *http.Request) {
 	})
 	log.Info().Msgf("Memory usage of languageMap values: %d bytes\n", sum)
 	sum = 0
-	for ngram, bitmap := range search.ngramMap {
+	for ngram, bitmap := range g.search.ngramMap {
 		size := bitmap.UnsafeBitmap().GetSizeInBytes()
 		if size > 1024*1024 {
 			log.Info().Msgf("memory usage of ngram[%s]: %d bytes\n", ngram, size)
 		}
 		sum += size
 	}
-	log.Info().Msgf("Memory usage (total) of search index: %d bytes\n", int(sum)+calculateMemoryUsage(search.ngramMap))
+	log.Info().Msgf("Memory usage (total) of search index: %d bytes\n", int(sum)+calculateMemoryUsage(g.search.ngramMap))
 	runtime.GC()
 }
 
 func uiHandler(w http.ResponseWriter, r *http.Request) {
-	uiPrefix := "ui"
 	var err error
 	if uiCache == nil {
 		uiCache, err = bigcache.NewBigCache(bigcache.DefaultConfig(30 * time.Minute))
@@ -208,10 +278,10 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 	if s3Client == nil {
 		getS3Client()
 	}
-	key := uiPrefix + path
+	key := cfg.UIPrefix + path
 	log.Trace().Str("key", key).Msg("reading s3")
 	resp, err := s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String("deep-libby"),
+		Bucket: aws.String(cfg.S3Bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
@@ -222,8 +292,8 @@ func uiHandler(w http.ResponseWriter, r *http.Request) {
 		log.Trace().Msg(err.Error())
 		if strings.Contains(err.Error(), "NoSuchKey") {
 			resp, err = s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-				Bucket: aws.String("deep-libby"),
-				Key:    aws.String(uiPrefix + "/index.html"),
+				Bucket: aws.String(cfg.S3Bucket),
+				Key:    aws.String(cfg.UIPrefix + "/index.html"),
 			})
 		}
 	}
@@ -309,9 +379,9 @@ func getFromUICache(w http.ResponseWriter, path, acceptEncoding string) bool {
 }
 
 func getS3Client() {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("us-east-1"))
+	awsConfig, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(cfg.S3Region))
 	if err != nil {
-		log.Error().Err(err)
+		log.Error().Err(err).Msg("failed to load aws config")
 	}
-	s3Client = s3.NewFromConfig(cfg)
+	s3Client = s3.NewFromConfig(awsConfig)
 }
@@ -2,23 +2,17 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"database/sql"
-	"encoding/csv"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"github.com/RoaringBitmap/roaring"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/dgraph-io/badger/v4"
 	_ "github.com/marcboeker/go-duckdb"
 	"github.com/rs/zerolog/log"
 	"io"
-	"math"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,9 +26,6 @@ type MediaCreator struct {
 	SortName string `json:"sortName"`
 }
 
-var formatMap sync.Map
-var languageMap sync.Map
-
 type Identifier struct {
 	Type  string `json:"type"`
 	Value string `json:"value"`
@@ -212,8 +203,8 @@ type Media struct {
 	Ids             []string
 }
 
-func getMediaKey(mediaId uint32) []byte {
-	return append([]byte("mk"), []byte(strconv.Itoa(int(mediaId)))...)
+func (g *generation) getMediaKey(mediaId uint32) []byte {
+	return g.key([]byte("mk"), []byte(strconv.Itoa(int(mediaId))))
 }
 
 func getAllMedia() {
@@ -324,7 +315,7 @@ func getAllMedia() {
 			if err != nil {
 				log.Error().Err(err).Msg("failed to insert record")
 			} else {
-				log.Trace().Msgf("successfully inserted record with id: %d", overdriveBulkResponse.Id)
+				log.Trace().Msgf("successfully inserted record with id: %s", overdriveBulkResponse.Id)
 			}
 		}
 	}
@@ -434,7 +425,7 @@ func getAllMediaIndividually() {
 			if err != nil {
 				log.Error().Err(err).Msg("failed to insert record")
 			} else {
-				log.Trace().Msgf("successfully inserted record with id: %d", overdriveBulkResponse.Id)
+				log.Trace().Msgf("successfully inserted record with id: %s", overdriveBulkResponse.Id)
 			}
 		}
 		insertStmt.Close()
@@ -442,64 +433,40 @@ func getAllMediaIndividually() {
 	log.Info().Msg("done getAllMedia")
 }
 
-func readMedia() {
+func (g *generation) readMedia() error {
 	loadDone := false
-	if onDiskSize, _ := db.EstimateSize(nil); onDiskSize > 10000 {
+	mediaPrefix := g.key([]byte("mk"))
+	if onDiskSize, _ := db.EstimateSize(mediaPrefix); onDiskSize > 10000 {
 		log.Info().Msg("media already loaded")
-		if os.Getenv("LOAD_ONLY") == "true" {
+		if cfg.LoadOnly {
 			log.Info().Msg("load only mode, running load anyway")
 		} else {
 			loadDone = true
 		}
 	}
-	var err error
-	if err != nil {
-		log.Error().Err(err)
-	}
-	languageMap = sync.Map{}
-	formatMap = sync.Map{}
 	startTime := time.Now()
 	if !loadDone {
-		var gzr *gzip.Reader
-		if os.Getenv("LOCAL_TESTING") == "true" {
-			f, err := os.Open("../../librarylibrary/media.csv.gz")
-			defer f.Close()
-			if err != nil {
-				log.Error().Err(err)
-			}
-			gzr, err = gzip.NewReader(f)
-			if err != nil {
-				log.Error().Err(err)
-			}
-		} else {
-			s3Path := "media.csv.gz"
-			if s3Client == nil {
-				getS3Client()
-			}
-			resp, err := s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-				Bucket: aws.String("deep-libby"),
-				Key:    aws.String(s3Path),
-			})
-			if err != nil {
-				log.Error().Err(err)
-			}
-			defer resp.Body.Close()
-			gzr, err = gzip.NewReader(resp.Body)
-			if err != nil {
-				log.Error().Err(err)
-			}
+		cr, closer, err := openGzipCSV(dataSource, "media.csv.gz")
+		if err != nil {
+			return err
 		}
-		cr := csv.NewReader(gzr)
+		report := newIngestReport("media")
 		var count int
 		for {
-			record, err := cr.Read()
+			record, line, err := report.readRow(cr)
 			if err == io.EOF {
 				break
 			}
 			if err != nil {
-				log.Error().Err(err)
+				closer.Close()
+				return fmt.Errorf("reading media: %w", err)
+			}
+			_, err = g.handleRecord(record)
+			if err != nil {
+				report.reject(line, err.Error(), record)
+				continue
 			}
-			handleRecord(record)
+			report.accept()
 			count++
 			if count%100000 == 0 {
 				duration := time.Since(startTime)
@@ -507,26 +474,30 @@ func readMedia() {
 				log.Info().Msgf("worker%d read %d media; avgTimePerRecord(ns): %d", 0, count, avgTimePerRecord)
 			}
 		}
-		gzr.Close()
+		closer.Close()
+		if err := report.finish(); err != nil {
+			return err
+		}
 	}
 
 	// index media
 	log.Info().Msg("indexing media")
-	db.View(func(txn *badger.Txn) error {
+	err := db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
-		opts.Prefix = []byte("mk")
+		opts.Prefix = mediaPrefix
 		iter := txn.NewIterator(opts)
 		defer iter.Close()
 		count := 0
-		for iter.Rewind(); iter.ValidForPrefix([]byte("mk")); iter.Next() {
+		for iter.Rewind(); iter.ValidForPrefix(mediaPrefix); iter.Next() {
 			item := iter.Item()
 			err := item.Value(func(val []byte) error {
 				media := &Media{}
 				err := gob.NewDecoder(bytes.NewReader(val)).Decode(media)
 				if err != nil {
-					log.Error().Err(err)
+					log.Error().Err(err).Msgf("failed to decode media key %s", item.Key())
+					return nil
 				}
-				indexMedia(media)
+				g.indexMedia(media)
 				return nil
 			})
 			if err != nil {
@@ -539,71 +510,85 @@ func readMedia() {
 		}
 		return nil
 	})
-	search.Finalize()
+	if err != nil {
+		return fmt.Errorf("indexing media: %w", err)
+	}
+	g.search.Finalize()
 	log.Info().Msg("done reading media")
+	return nil
 }
 
-func handleRecord(record []string) *Media {
-	var creators []MediaCreator
-	err := json.Unmarshal([]byte(record[2]), &creators)
-	if err != nil {
-		log.Error().Err(err)
+// parseMediaRecord validates a media.csv row:
+// id, title, creators (json), languages, coverUrl, formats, subtitle,
+// description, series, seriesReadOrder, identifiers, publisher, publisherId
+func parseMediaRecord(record []string) (*Media, error) {
+	if err := checkFieldCount(record, 13); err != nil {
+		return nil, err
 	}
-	languages := strings.Split(record[3], ";")
-	formats := strings.Split(record[5], ";")
-	identifiers := strings.Split(record[10], ";")
 	mediaId, err := strconv.ParseUint(record[0], 10, 32)
-	if mediaId > math.MaxUint32 {
-		log.Warn().Msgf("mediaId too large %d", mediaId)
+	if err != nil {
+		return nil, fmt.Errorf("invalid media id %q", record[0])
 	}
+	var creators []MediaCreator
+	err = json.Unmarshal([]byte(record[2]), &creators)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid creators json: %v", err)
 	}
 	publisherId, err := strconv.ParseUint(record[12], 10, 32)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid publisherId %q", record[12])
 	}
-	seriesReadOrder, err := strconv.Atoi(record[9])
+	// series read order is free text upstream, anything that isn't a number is dropped
+	seriesReadOrder, err := strconv.ParseUint(record[9], 10, 16)
 	if err != nil {
-		log.Error().Err(err)
+		seriesReadOrder = 0
 	}
-	media := &Media{
+	return &Media{
 		Id:              uint32(mediaId),
 		Title:           record[1],
 		Creators:        creators,
 		Publisher:       record[11],
 		PublisherId:     uint32(publisherId),
-		Languages:       languages,
+		Languages:       strings.Split(record[3], ";"),
 		CoverUrl:        record[4],
-		Formats:         formats,
+		Formats:         strings.Split(record[5], ";"),
 		Subtitle:        record[6],
 		Description:     record[7],
 		Series:          record[8],
 		SeriesReadOrder: uint16(seriesReadOrder),
-		Ids:             identifiers,
+		Ids:             strings.Split(record[10], ";"),
+	}, nil
+}
+
+func (g *generation) handleRecord(record []string) (*Media, error) {
+	media, err := parseMediaRecord(record)
+	if err != nil {
+		return nil, err
 	}
 	buf := bytes.Buffer{}
 	err = gob.NewEncoder(&buf).Encode(media)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("encoding media: %w", err)
 	}
 	// insert into db
-	txn := db.NewTransaction(true)
-	err = txn.Set(getMediaKey(media.Id), buf.Bytes())
-	if err != nil {
-		panic(err)
-	}
-	err = txn.Commit()
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set(g.getMediaKey(media.Id), buf.Bytes())
+	})
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("writing media: %w", err)
 	}
-	//log.Debug().Msgf("mediaId: %d %v", media.Id, identifiers)
-	return media
+	return media, nil
 }
 
-func getMedia(mediaId uint32) (*Media, error) {
+func (g *generation) getMedia(mediaId uint32) (*Media, error) {
 	txn := db.NewTransaction(false)
-	buf, err := txn.Get(getMediaKey(mediaId))
+	defer txn.Discard()
+	return g.getMediaTxn(txn, mediaId)
+}
+
+// getMediaTxn reads a media in txn, for callers reading many media at once
+func (g *generation) getMediaTxn(txn *badger.Txn, mediaId uint32) (*Media, error) {
+	buf, err := txn.Get(g.getMediaKey(mediaId))
 	if err != nil {
 		return nil, err
 	}
@@ -611,39 +596,38 @@ func getMedia(mediaId uint32) (*Media, error) {
 	err = buf.Value(func(val []byte) error {
 		return gob.NewDecoder(bytes.NewReader(val)).Decode(media)
 	})
-	txn.Discard()
 	if err != nil {
 		return nil, err
 	}
 	return media, nil
 }
 
-func indexMedia(media *Media) {
-	indexStrings(media.Languages, &languageMap, media.Id)
-	indexStrings(media.Formats, &formatMap, media.Id)
-	search.Index(" "+media.Title+" ", media.Id)
-	search.Index(" "+media.Subtitle+" ", media.Id)
-	search.Index(" "+media.Publisher+" ", media.Id)
-	search.Index(fmt.Sprintf(" %s-%d ", media.Publisher, media.PublisherId), media.Id)
+func (g *generation) indexMedia(media *Media) {
+	g.indexStrings(media.Languages, g.languageMap, media.Id)
+	g.indexStrings(media.Formats, g.formatMap, media.Id)
+	g.search.Index(" "+media.Title+" ", media.Id)
+	g.search.Index(" "+media.Subtitle+" ", media.Id)
+	g.search.Index(" "+media.Publisher+" ", media.Id)
+	g.search.Index(fmt.Sprintf(" %s-%d ", media.Publisher, media.PublisherId), media.Id)
 	if media.Series != "" {
-		search.Index(fmt.Sprintf("#%d", media.SeriesReadOrder), media.Id)
-		search.Index(" "+media.Series+" ", media.Id)
+		g.search.Index(fmt.Sprintf("#%d", media.SeriesReadOrder), media.Id)
+		g.search.Index(" "+media.Series+" ", media.Id)
 	}
 	for _, creator := range media.Creators {
-		search.Index(" "+creator.Name+" ", media.Id)
+		g.search.Index(" "+creator.Name+" ", media.Id)
 	}
 	for _, identifier := range media.Ids {
-		search.Index(" "+identifier+" ", media.Id)
-		if len(identifier) == 13 && (strings.HasPrefix(identifier, "979") || strings.HasPrefix(identifier, "978")) {
+		g.search.Index(" "+identifier+" ", media.Id)
+		if isIsbn13(identifier) {
 			idInt, err := strconv.ParseUint(identifier, 10, 64)
 			if err == nil {
-				search.IndexISBN(idInt, media.Id)
+				g.search.IndexISBN(idInt, media.Id)
 			}
 		}
 	}
 }
 
-func indexStrings(stringSlice []string, bitmapMap *sync.Map, mediaId uint32) {
+func (g *generation) indexStrings(stringSlice []string, bitmapMap *sync.Map, mediaId uint32) {
 	for _, str := range stringSlice {
 		bitmap, bitmapExists := bitmapMap.Load(strings.ToLower(str))
 		if !bitmapExists {
@@ -653,6 +637,21 @@ func indexStrings(stringSlice []string, bitmapMap *sync.Map, mediaId uint32) {
 			bitmapMap.Store(strings.ToLower(str), bitmap)
 		}
 		bitmap.(*ConcurrentBitmap).Add(mediaId)
-		search.Index(strings.ToLower(str), mediaId)
+		g.search.Index(strings.ToLower(str), mediaId)
+	}
+}
+
+func isIsbn13(identifier string) bool {
+	return len(identifier) == 13 && (strings.HasPrefix(identifier, "979") || strings.HasPrefix(identifier, "978"))
+}
+
+// getIsbns returns the isbn-13s among the identifiers of a media
+func getIsbns(identifiers []string) []string {
+	isbns := []string{}
+	for _, identifier := range identifiers {
+		if isIsbn13(identifier) {
+			isbns = append(isbns, identifier)
+		}
 	}
+	return isbns
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/smtp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// notifierTimeout bounds a single delivery
+const notifierTimeout = 10 * time.Second
+
+// nonPublicPrefixes are the ranges besides loopback, link-local and private
+// ones that webhooks can't reach
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// Notifier delivers the alerts of a watchlist raised by one evaluation
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, watchlist *Watchlist, alerts []WatchlistAlert) error
+}
+
+// notifiersFor returns the notifiers a watchlist asked for, email is skipped
+// until it's confirmed and when no smtp server is configured
+func notifiersFor(watchlist *Watchlist) []Notifier {
+	var notifiers []Notifier
+	if watchlist.Email != "" && watchlist.EmailConfirmed && cfg.SMTPAddr != "" {
+		notifiers = append(notifiers, newSMTPNotifier())
+	}
+	if watchlist.WebhookUrl != "" {
+		notifiers = append(notifiers, &webhookNotifier{client: newWatchlistWebhookClient()})
+	}
+	return notifiers
+}
+
+func alertSummary(alert WatchlistAlert) string {
+	switch alert.Kind {
+	case alertKindAvailable:
+		return fmt.Sprintf("%s is available at %s", alert.Title, alert.LibraryId)
+	case alertKindNewLibrary:
+		return fmt.Sprintf("%s was added at %s", alert.Title, alert.LibraryId)
+	default:
+		return fmt.Sprintf("%s has a %d day wait at %s", alert.Title, alert.EstimatedWaitDays, alert.LibraryId)
+	}
+}
+
+type smtpNotifier struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+func newSMTPNotifier() *smtpNotifier {
+	return &smtpNotifier{
+		addr:     cfg.SMTPAddr,
+		from:     cfg.SMTPFrom,
+		username: cfg.SMTPUsername,
+		password: cfg.SMTPPassword,
+	}
+}
+
+// sendEmailConfirmation mails the link that confirms the email of a watchlist
+func sendEmailConfirmation(watchlist *Watchlist, confirmUrl string) {
+	if cfg.SMTPAddr == "" {
+		return
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", cfg.SMTPFrom)
+	fmt.Fprintf(&body, "To: %s\r\n", watchlist.Email)
+	body.WriteString("Subject: deep libby: confirm your watchlist email\r\n")
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString("Follow this link to get watchlist alerts at this address:\r\n" + confirmUrl + "\r\n")
+	ctx, cancel := context.WithTimeout(context.Background(), notifierTimeout)
+	defer cancel()
+	if err := newSMTPNotifier().sendMail(ctx, watchlist.Email, body.String()); err != nil {
+		log.Error().Err(err).Str("watchlist", watchlist.Id).Msg("failed to send watchlist email confirmation")
+	}
+}
+
+func (n *smtpNotifier) Name() string {
+	return "smtp"
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, watchlist *Watchlist, alerts []WatchlistAlert) error {
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", n.from)
+	fmt.Fprintf(&body, "To: %s\r\n", watchlist.Email)
+	fmt.Fprintf(&body, "Subject: deep libby: %d watchlist alerts\r\n", len(alerts))
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, alert := range alerts {
+		body.WriteString(alertSummary(alert) + "\r\n")
+	}
+	return n.sendMail(ctx, watchlist.Email, body.String())
+}
+
+// sendMail is smtp.SendMail bounded by ctx, a stalled server can't hold up the caller
+func (n *smtpNotifier) sendMail(ctx context.Context, to string, msg string) error {
+	host, _, _ := strings.Cut(n.addr, ":")
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.username != "" {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(smtp.PlainAuth("", n.username, n.password, host)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// isPublicAddr reports whether addr is on the public internet
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicDialControl refuses connections to addresses that aren't public. it
+// sees the resolved address, so a hostname can't point a webhook at the server's network
+func publicDialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("webhook address %s is not public", addrPort.Addr())
+	}
+	return nil
+}
+
+// newWatchlistWebhookClient posts to the webhooks anyone can set on a
+// watchlist, it only connects to public addresses and doesn't use a proxy
+func newWatchlistWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: notifierTimeout, Control: publicDialControl}
+	return &http.Client{
+		Timeout:   notifierTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: notifierTimeout},
+	}
+}
+
+type webhookNotifier struct {
+	client *http.Client
+}
+
+type WatchlistWebhookPayload struct {
+	WatchlistId string           `json:"watchlistId"`
+	Alerts      []WatchlistAlert `json:"alerts"`
+}
+
+func (n *webhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, watchlist *Watchlist, alerts []WatchlistAlert) error {
+	payload, err := json.Marshal(WatchlistWebhookPayload{
+		WatchlistId: watchlist.Id,
+		Alerts:      alerts,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, watchlist.WebhookUrl, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
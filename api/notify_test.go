@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAlerts = []WatchlistAlert{
+	{MediaId: 1, Title: "Book 1", LibraryId: "nypl", Kind: alertKindAvailable, AvailableCount: 1},
+	{MediaId: 2, Title: "Book 2", LibraryId: "bpl", Kind: alertKindWait, EstimatedWaitDays: 6},
+}
+
+// smtpMessage is what the stub received in one session
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// startSMTPStub accepts one smtp session on a local port and sends what it
+// received on the channel
+func startSMTPStub(t *testing.T) (string, <-chan smtpMessage) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	messages := make(chan smtpMessage, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 stub")
+		var message smtpMessage
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if inData {
+				if line == "." {
+					inData = false
+					message.data = data.String()
+					reply("250 ok")
+					continue
+				}
+				data.WriteString(line + "\n")
+				continue
+			}
+			command, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(command) {
+			case "EHLO", "HELO":
+				reply("250 stub")
+			case "MAIL":
+				message.from = arg
+				reply("250 ok")
+			case "RCPT":
+				message.to = append(message.to, arg)
+				reply("250 ok")
+			case "DATA":
+				inData = true
+				reply("354 go ahead")
+			case "QUIT":
+				reply("221 bye")
+				messages <- message
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	addr, messages := startSMTPStub(t)
+	notifier := &smtpNotifier{addr: addr, from: "alerts@deeplibby.com"}
+	watchlist := &Watchlist{Id: "w1", Email: "reader@example.com"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := notifier.Notify(ctx, watchlist, testAlerts); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	var message smtpMessage
+	select {
+	case message = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stub didn't receive a message")
+	}
+	if message.from != "FROM:<alerts@deeplibby.com>" {
+		t.Errorf("from = %q", message.from)
+	}
+	if len(message.to) != 1 || message.to[0] != "TO:<reader@example.com>" {
+		t.Errorf("to = %q", message.to)
+	}
+	for _, want := range []string{
+		"To: reader@example.com\n",
+		"Subject: deep libby: 2 watchlist alerts\n",
+		"Book 1 is available at nypl\n",
+		"Book 2 has a 6 day wait at bpl\n",
+	} {
+		if !strings.Contains(message.data, want) {
+			t.Errorf("message is missing %q:\n%s", want, message.data)
+		}
+	}
+}
+
+func TestSMTPNotifierDisplayName(t *testing.T) {
+	request := &WatchlistRequest{MediaIds: []uint32{1}, Email: "Some Reader <reader@example.com>"}
+	if err := request.validate(newGeneration(0)); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if request.Email != "reader@example.com" {
+		t.Fatalf("email = %q, want the address without the display name", request.Email)
+	}
+	addr, messages := startSMTPStub(t)
+	notifier := &smtpNotifier{addr: addr, from: "alerts@deeplibby.com"}
+	watchlist := &Watchlist{Id: "w1", Email: request.Email}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := notifier.Notify(ctx, watchlist, testAlerts); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	select {
+	case message := <-messages:
+		if len(message.to) != 1 || message.to[0] != "TO:<reader@example.com>" {
+			t.Errorf("to = %q", message.to)
+		}
+		if !strings.Contains(message.data, "To: reader@example.com\n") {
+			t.Errorf("message has the wrong To header:\n%s", message.data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stub didn't receive a message")
+	}
+}
+
+func TestSMTPNotifierTimeout(t *testing.T) {
+	// a server that accepts but never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	notifier := &smtpNotifier{addr: listener.Addr().String(), from: "alerts@deeplibby.com"}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = notifier.Notify(ctx, &Watchlist{Id: "w1", Email: "reader@example.com"}, testAlerts)
+	if err == nil {
+		t.Fatal("Notify succeeded against a stalled server")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Notify took %s, the context allowed 200ms", elapsed)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received WatchlistWebhookPayload
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+	}))
+	defer server.Close()
+	notifier := &webhookNotifier{client: server.Client()}
+	watchlist := &Watchlist{Id: "w1", WebhookUrl: server.URL}
+	if err := notifier.Notify(context.Background(), watchlist, testAlerts); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if contentType != "application/json" {
+		t.Errorf("content type = %q", contentType)
+	}
+	if received.WatchlistId != "w1" || len(received.Alerts) != 2 || received.Alerts[1].Title != "Book 2" {
+		t.Errorf("payload = %+v", received)
+	}
+}
+
+func TestWebhookNotifierError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	notifier := &webhookNotifier{client: server.Client()}
+	err := notifier.Notify(context.Background(), &Watchlist{Id: "w1", WebhookUrl: server.URL}, testAlerts)
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("Notify = %v, want a 502 error", err)
+	}
+}
+
+func TestWebhookNotifierRefusesLoopback(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+	notifier := &webhookNotifier{client: newWatchlistWebhookClient()}
+	err := notifier.Notify(context.Background(), &Watchlist{Id: "w1", WebhookUrl: server.URL}, testAlerts)
+	if err == nil || !strings.Contains(err.Error(), "not public") {
+		t.Errorf("Notify = %v, want a not public error", err)
+	}
+	if called {
+		t.Error("the loopback webhook was called")
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+	}
+	for _, test := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(test.addr)); got != test.want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+}
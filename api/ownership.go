@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// buildOwnershipBitmaps reads the la keys of g into one bitmap of media ids per
+// library. only keys are read, counts are looked up for the media that end up
+// in a response
+func (g *generation) buildOwnershipBitmaps() error {
+	start := time.Now()
+	libraryBitmaps := map[uint16]*roaring.Bitmap{}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = g.key([]byte("la"))
+		opts.PrefetchValues = false
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			key := g.trimNamespace(iter.Item().Key())
+			libraryIdInt := binary.BigEndian.Uint16(key[2:])
+			bitmap, exists := libraryBitmaps[libraryIdInt]
+			if !exists {
+				bitmap = roaring.New()
+				libraryBitmaps[libraryIdInt] = bitmap
+			}
+			bitmap.Add(binary.BigEndian.Uint32(key[4:]))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, bitmap := range libraryBitmaps {
+		bitmap.RunOptimize()
+	}
+	g.libraryBitmaps = libraryBitmaps
+	log.Info().Int("libraries", len(libraryBitmaps)).
+		Dur("duration", time.Since(start)).
+		Msg("built ownership bitmaps")
+	return nil
+}
+
+// libraryBitmap is the set of media owned by a library, empty when it owns nothing
+func (g *generation) libraryBitmap(libraryIdInt uint16) *roaring.Bitmap {
+	bitmap, exists := g.libraryBitmaps[libraryIdInt]
+	if !exists {
+		return roaring.New()
+	}
+	return bitmap
+}
+
+// getLibraryMediaCounts reads the counts of one media at one library, with the
+// wait estimated from its policy and history
+func (g *generation) getLibraryMediaCounts(txn *badger.Txn, libraryIdInt uint16, mediaId uint32) (*MediaCounts, error) {
+	item, err := txn.Get(g.getLibraryAvailabilityKey(libraryIdInt, uint64(mediaId)))
+	if err != nil {
+		return nil, err
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := decodeMediaCounts(val)
+	if err != nil {
+		return nil, err
+	}
+	velocity := 0.0
+	// the velocity only matters to titles with a queue
+	if counts.OwnedCount > 0 && counts.AvailableCount <= counts.HoldsCount {
+		velocity, err = g.cachedQueueVelocity(txn, mediaId, libraryIdInt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	g.applyWaitEstimate(libraryIdInt, counts, velocity)
+	return counts, nil
+}
+
+type Page struct {
+	Offset int
+	// Limit is -1 when every result after Offset is returned
+	Limit int
+}
+
+var errInvalidPage = errors.New("invalid offset or limit")
+
+// parsePage reads the offset and limit query params, without a limit the whole
+// result is returned so existing callers keep working
+func parsePage(r *http.Request) (Page, error) {
+	page := Page{Limit: -1}
+	if offset := r.URL.Query().Get("offset"); offset != "" {
+		value, err := strconv.Atoi(offset)
+		if err != nil || value < 0 {
+			return page, fmt.Errorf("%w: offset %q", errInvalidPage, offset)
+		}
+		page.Offset = value
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 0 {
+			return page, fmt.Errorf("%w: limit %q", errInvalidPage, limit)
+		}
+		page.Limit = value
+	}
+	return page, nil
+}
+
+// ids returns the media ids of the page in ascending order
+func (p Page) ids(bitmap *roaring.Bitmap) []uint32 {
+	total := bitmap.GetCardinality()
+	if uint64(p.Offset) >= total || p.Limit == 0 {
+		return []uint32{}
+	}
+	size := total - uint64(p.Offset)
+	if p.Limit > 0 && uint64(p.Limit) < size {
+		size = uint64(p.Limit)
+	}
+	first, err := bitmap.Select(uint32(p.Offset))
+	if err != nil {
+		return []uint32{}
+	}
+	ids := make([]uint32, 0, size)
+	iter := bitmap.Iterator()
+	iter.AdvanceIfNeeded(first)
+	for iter.HasNext() && uint64(len(ids)) < size {
+		ids = append(ids, iter.Next())
+	}
+	return ids
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	// defaultHoldLimit is the hold cap of a library card when neither the request
+	// nor the library's policy has one
+	defaultHoldLimit = 10
+	// maxPlanLimit bounds the hold and loan limits a request can ask for
+	maxPlanLimit = 1000
+)
+
+type PlanHoldsRequest struct {
+	Ids   []uint32 `json:"ids"`
+	Isbns []string `json:"isbns"`
+	// Libraries are the user's cards, with how many holds each allows at once
+	Libraries         []PlanLibrary `json:"libraries"`
+	IncludeConsortium bool          `json:"includeConsortium"`
+}
+
+type PlanLibrary struct {
+	LibraryId string `json:"libraryId"`
+	// HoldLimit is the library policy's max holds when 0, else defaultHoldLimit
+	HoldLimit int `json:"holdLimit"`
+	// LoanLimit is the library policy's max loans when 0, else loans aren't capped
+	LoanLimit int `json:"loanLimit"`
+}
+
+// PlannedTitle is a step of the plan. StartDays is when the hold can be placed,
+// 0 unless the library's holds are all taken, and ReadyDays when the title can
+// be borrowed
+type PlannedTitle struct {
+	*SearchResult
+	Library   Library `json:"library"`
+	StartDays int     `json:"startDays"`
+	ReadyDays int     `json:"readyDays"`
+	MediaCountResults
+}
+
+type PlanHoldsResponse struct {
+	// BorrowNow have a copy available at one of the libraries with loans left
+	BorrowNow []PlannedTitle `json:"borrowNow"`
+	// PlaceHolds can be placed right away within the hold limits
+	PlaceHolds []PlannedTitle `json:"placeHolds"`
+	// WaitFor have to wait for an earlier hold to come in before their hold is placed
+	WaitFor []PlannedTitle `json:"waitFor"`
+	// NotOwned aren't owned by any of the libraries
+	NotOwned []*SearchResult `json:"notOwned"`
+	// NotFound are the requested ids and isbns without media
+	NotFound []string `json:"notFound"`
+}
+
+// holdSlots holds the days at which each hold slot of a library frees up
+type holdSlots []int
+
+func (h holdSlots) Len() int           { return len(h) }
+func (h holdSlots) Less(i, j int) bool { return h[i] < h[j] }
+func (h holdSlots) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *holdSlots) Push(x any)        { *h = append(*h, x.(int)) }
+func (h *holdSlots) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// planOption is a title at one of the user's libraries
+type planOption struct {
+	libraryIdInt uint16
+	library      Library
+	counts       MediaCountResults
+}
+
+type planTitle struct {
+	result  *SearchResult
+	options []planOption
+	// bestWait is the shortest wait over the options, used to order the holds
+	bestWait int
+}
+
+func planWait(counts MediaCountResults) int {
+	return max(int(counts.EstimatedWaitDays), 0)
+}
+
+func planHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	var request PlanHoldsRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "invalid plan request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(request.Ids)+len(request.Isbns) == 0 {
+		http.Error(w, "ids or isbns are required", http.StatusBadRequest)
+		return
+	}
+	if len(request.Ids)+len(request.Isbns) > cfg.MaxBatchSize {
+		http.Error(w, fmt.Sprintf("at most %d titles can be planned", cfg.MaxBatchSize), http.StatusBadRequest)
+		return
+	}
+	if len(request.Libraries) == 0 {
+		http.Error(w, "libraries are required", http.StatusBadRequest)
+		return
+	}
+	slots := map[uint16]*holdSlots{}
+	// loans is how many loans are left at each library, -1 when they aren't capped
+	loans := map[uint16]int{}
+	cardOrder := map[uint16]int{}
+	for _, planLibrary := range request.Libraries {
+		libraryIdInt, library, exists := g.lookupLibrary(planLibrary.LibraryId)
+		if !exists {
+			http.Error(w, "invalid library id "+planLibrary.LibraryId, http.StatusBadRequest)
+			return
+		}
+		if planLibrary.HoldLimit < 0 || planLibrary.LoanLimit < 0 ||
+			planLibrary.HoldLimit > maxPlanLimit || planLibrary.LoanLimit > maxPlanLimit {
+			http.Error(w, "invalid limit for "+planLibrary.LibraryId, http.StatusBadRequest)
+			return
+		}
+		if _, exists := slots[libraryIdInt]; exists {
+			http.Error(w, "duplicate library id "+planLibrary.LibraryId, http.StatusBadRequest)
+			return
+		}
+		holdLimit, loanLimit := planLibrary.HoldLimit, planLibrary.LoanLimit
+		if library.Policy != nil {
+			holdLimit = cmp.Or(holdLimit, library.Policy.MaxHolds)
+			loanLimit = cmp.Or(loanLimit, library.Policy.MaxLoans)
+		}
+		// a plan never fills more slots than it has titles
+		librarySlots := make(holdSlots, min(cmp.Or(holdLimit, defaultHoldLimit), len(request.Ids)+len(request.Isbns)))
+		slots[libraryIdInt] = &librarySlots
+		loans[libraryIdInt] = cmp.Or(loanLimit, -1)
+		cardOrder[libraryIdInt] = len(cardOrder)
+	}
+	response := PlanHoldsResponse{
+		BorrowNow:  []PlannedTitle{},
+		PlaceHolds: []PlannedTitle{},
+		WaitFor:    []PlannedTitle{},
+		NotOwned:   []*SearchResult{},
+		NotFound:   []string{},
+	}
+	ids := []uint32{}
+	seen := map[uint32]bool{}
+	addId := func(id uint32) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range request.Ids {
+		addId(id)
+	}
+	for _, isbn := range request.Isbns {
+		isbnInt, err := strconv.ParseUint(isbn, 10, 64)
+		if !isIsbn13(isbn) || err != nil {
+			http.Error(w, "invalid isbn "+isbn, http.StatusBadRequest)
+			return
+		}
+		id, exists := g.search.SearchISBN(isbnInt)
+		if !exists {
+			response.NotFound = append(response.NotFound, isbn)
+			continue
+		}
+		addId(id)
+	}
+	log.Info().Msgf("/api/plan-holds titles: %d libraries: %d", len(ids), len(slots))
+	var titles []planTitle
+	err := db.View(func(txn *badger.Txn) error {
+		for _, id := range ids {
+			media, err := g.getMediaTxn(txn, id)
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				response.NotFound = append(response.NotFound, strconv.FormatUint(uint64(id), 10))
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			title := planTitle{result: g.NewSearchResultTxn(txn, media)}
+			for _, counts := range g.getMediaAvailability(txn, id, request.IncludeConsortium) {
+				libraryIdInt := g.libraryIdMap[counts.Library.Id]
+				if _, mine := slots[libraryIdInt]; !mine {
+					continue
+				}
+				title.options = append(title.options, planOption{
+					libraryIdInt: libraryIdInt,
+					library:      counts.Library,
+					counts:       counts.MediaCountResults,
+				})
+			}
+			if len(title.options) == 0 {
+				response.NotOwned = append(response.NotOwned, title.result)
+				continue
+			}
+			// the user's card order breaks ties between equally good libraries
+			sort.Slice(title.options, func(i, j int) bool {
+				a, b := title.options[i], title.options[j]
+				if planWait(a.counts) != planWait(b.counts) {
+					return planWait(a.counts) < planWait(b.counts)
+				}
+				return cardOrder[a.libraryIdInt] < cardOrder[b.libraryIdInt]
+			})
+			title.bestWait = planWait(title.options[0].counts)
+			titles = append(titles, title)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read plan availability")
+		http.Error(w, "failed to read plan availability", http.StatusInternalServerError)
+		return
+	}
+	var holds []planTitle
+	for _, title := range titles {
+		borrowed := false
+		for _, option := range title.options {
+			if option.counts.AvailableCount > 0 && loans[option.libraryIdInt] != 0 {
+				if loans[option.libraryIdInt] > 0 {
+					loans[option.libraryIdInt]--
+				}
+				response.BorrowNow = append(response.BorrowNow, PlannedTitle{
+					SearchResult:      title.result,
+					Library:           option.library,
+					MediaCountResults: option.counts,
+				})
+				borrowed = true
+				break
+			}
+		}
+		if !borrowed {
+			holds = append(holds, title)
+		}
+	}
+	// shortest waits first, so they take the hold slots and free them soonest
+	sort.SliceStable(holds, func(i, j int) bool {
+		return holds[i].bestWait < holds[j].bestWait
+	})
+	for _, title := range holds {
+		// the hold goes where it comes in first, counting the wait for a free slot
+		var best *planOption
+		bestStart, bestReady := 0, 0
+		for i, option := range title.options {
+			start := (*slots[option.libraryIdInt])[0]
+			ready := start + planWait(option.counts)
+			if best == nil || ready < bestReady {
+				best, bestStart, bestReady = &title.options[i], start, ready
+			}
+		}
+		librarySlots := slots[best.libraryIdInt]
+		heap.Pop(librarySlots)
+		heap.Push(librarySlots, bestReady)
+		planned := PlannedTitle{
+			SearchResult:      title.result,
+			Library:           best.library,
+			StartDays:         bestStart,
+			ReadyDays:         bestReady,
+			MediaCountResults: best.counts,
+		}
+		if bestStart == 0 {
+			response.PlaceHolds = append(response.PlaceHolds, planned)
+		} else {
+			response.WaitFor = append(response.WaitFor, planned)
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode hold plan")
+	}
+}
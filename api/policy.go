@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/fs"
+	"math"
+	"strconv"
+)
+
+// library policies come from the optional library-policies.csv.gz (libraryId,
+// maxHolds, maxLoans, loanPeriodDays, skipTheLine, kindle). the loan period is
+// used by the wait estimate, the limits are the defaults of the hold planner
+
+// LibraryPolicy limits are 0 when the library doesn't publish them
+type LibraryPolicy struct {
+	MaxHolds       int  `json:"maxHolds,omitempty"`
+	MaxLoans       int  `json:"maxLoans,omitempty"`
+	LoanPeriodDays int  `json:"loanPeriodDays,omitempty"`
+	SkipTheLine    bool `json:"skipTheLine"`
+	Kindle         bool `json:"kindle"`
+}
+
+// readLibraryPolicies loads library-policies.csv.gz into g.libraryMap, libraries need to be loaded first
+func (g *generation) readLibraryPolicies() error {
+	cr, closer, err := openGzipCSV(dataSource, "library-policies.csv.gz")
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Info().Msg("no library-policies.csv.gz, skipping library policies")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	report := newIngestReport("library-policies")
+	for {
+		record, line, err := report.readRow(cr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading library policies: %w", err)
+		}
+		libraryIdInt, policy, err := g.parseLibraryPolicyRecord(record)
+		if err != nil {
+			report.reject(line, err.Error(), record)
+			continue
+		}
+		library := g.libraryMap[libraryIdInt]
+		library.Policy = policy
+		g.libraryMap[libraryIdInt] = library
+		report.accept()
+	}
+	log.Info().Msg("done reading library policies")
+	return report.finish()
+}
+
+// parseLibraryPolicyRecord validates a row of library-policies.csv.gz:
+// libraryId, maxHolds, maxLoans, loanPeriodDays, skipTheLine, kindle. empty
+// numbers are unknown
+func (g *generation) parseLibraryPolicyRecord(record []string) (uint16, *LibraryPolicy, error) {
+	if err := checkFieldCount(record, 6); err != nil {
+		return 0, nil, err
+	}
+	libraryIdInt, exists := g.libraryIdMap[record[0]]
+	if !exists {
+		return 0, nil, fmt.Errorf("library id not found %q", record[0])
+	}
+	if g.libraryMap[libraryIdInt].Policy != nil {
+		return 0, nil, fmt.Errorf("duplicate policy for %q", record[0])
+	}
+	if record[4] != "true" && record[4] != "false" {
+		return 0, nil, fmt.Errorf("invalid skipTheLine %q", record[4])
+	}
+	if record[5] != "true" && record[5] != "false" {
+		return 0, nil, fmt.Errorf("invalid kindle %q", record[5])
+	}
+	policy := &LibraryPolicy{
+		SkipTheLine: record[4] == "true",
+		Kindle:      record[5] == "true",
+	}
+	var err error
+	if policy.MaxHolds, err = parsePolicyLimit("maxHolds", record[1]); err != nil {
+		return 0, nil, err
+	}
+	if policy.MaxLoans, err = parsePolicyLimit("maxLoans", record[2]); err != nil {
+		return 0, nil, err
+	}
+	if policy.LoanPeriodDays, err = parsePolicyLimit("loanPeriodDays", record[3]); err != nil {
+		return 0, nil, err
+	}
+	return libraryIdInt, policy, nil
+}
+
+// parsePolicyLimit parses a positive limit, 0 when it's empty
+func parsePolicyLimit(name, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > math.MaxInt16 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return limit, nil
+}
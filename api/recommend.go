@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// recommendWaitHalfLife is the wait in days at which a title counts half in the
+// score of a library, a title that's available now counts fully
+const recommendWaitHalfLife = 14.0
+
+type LibraryRecommendation struct {
+	Library Library `json:"library"`
+	// NewTitles is the number of missing (or wishlist) titles the library adds
+	NewTitles uint64 `json:"newTitles"`
+	// AvailableNow is the number of added wishlist titles with a copy available, only set for a wishlist
+	AvailableNow uint64 `json:"availableNow"`
+	// WaitDays is the average wait of the added wishlist titles, or the library's median wait without a wishlist
+	WaitDays float64 `json:"waitDays"`
+	// Score is the number of added titles weighted down by their wait
+	Score    float64  `json:"score"`
+	MediaIds []uint32 `json:"mediaIds,omitempty"`
+}
+
+type RecommendLibraryResponse struct {
+	Libraries       []Library               `json:"libraries"`
+	Wishlist        uint64                  `json:"wishlist"`
+	Missing         uint64                  `json:"missing"`
+	Recommendations []LibraryRecommendation `json:"recommendations"`
+}
+
+func waitWeight(waitDays float64) float64 {
+	return 1 / (1 + max(waitDays, 0)/recommendWaitHalfLife)
+}
+
+// queryValues returns every value of a repeated and/or comma separated query param
+func queryValues(r *http.Request, name string) []string {
+	var values []string
+	for _, value := range r.URL.Query()[name] {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+	return values
+}
+
+func recommendLibraryHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	current := map[uint16]bool{}
+	libraries := []Library{}
+	owned := roaring.New()
+	for _, libraryId := range queryValues(r, "libraryId") {
+		libraryIdInt, library, exists := g.lookupLibrary(libraryId)
+		if !exists {
+			http.Error(w, "invalid library id "+libraryId, http.StatusBadRequest)
+			return
+		}
+		current[libraryIdInt] = true
+		libraries = append(libraries, library)
+		owned.Or(g.libraryBitmap(libraryIdInt))
+	}
+	wishlist := roaring.New()
+	for _, mediaId := range queryValues(r, "mediaId") {
+		id, err := strconv.ParseUint(mediaId, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid media id "+mediaId, http.StatusBadRequest)
+			return
+		}
+		wishlist.Add(uint32(id))
+	}
+	for _, isbn := range queryValues(r, "isbn") {
+		isbnInt, err := strconv.ParseUint(isbn, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid isbn "+isbn, http.StatusBadRequest)
+			return
+		}
+		if id, exists := g.search.SearchISBN(isbnInt); exists {
+			wishlist.Add(id)
+		}
+	}
+	limit := 20
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	filter, err := parseLibraryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hasWishlist := !wishlist.IsEmpty()
+	if !hasWishlist && (r.URL.Query().Has("mediaId") || r.URL.Query().Has("isbn")) {
+		http.Error(w, "no wishlist title was found", http.StatusNotFound)
+		return
+	}
+	log.Info().Msgf("/api/recommend-library libraries: %d wishlist: %d", len(libraries), wishlist.GetCardinality())
+	// without a wishlist every title none of the current libraries own is missing
+	missing := wishlist
+	if !hasWishlist {
+		missing = roaring.New()
+		for libraryIdInt := range g.visibility().libraries {
+			missing.Or(g.libraryBitmap(libraryIdInt))
+		}
+	}
+	missing = roaring.AndNot(missing, owned)
+	recommendations := []LibraryRecommendation{}
+	err = db.View(func(txn *badger.Txn) error {
+		for libraryIdInt, library := range g.visibility().libraries {
+			if current[libraryIdInt] || !filter.matches(library) {
+				continue
+			}
+			added := roaring.And(g.libraryBitmap(libraryIdInt), missing)
+			if added.IsEmpty() {
+				continue
+			}
+			recommendation := LibraryRecommendation{
+				Library:   library,
+				NewTitles: added.GetCardinality(),
+			}
+			if !hasWishlist {
+				recommendation.WaitDays = float64(g.getLibraryStats(libraryIdInt).MedianWaitDays)
+				recommendation.Score = float64(recommendation.NewTitles) * waitWeight(recommendation.WaitDays)
+				recommendations = append(recommendations, recommendation)
+				continue
+			}
+			recommendation.MediaIds = added.ToArray()
+			totalWait := 0.0
+			for _, id := range recommendation.MediaIds {
+				counts, err := g.getLibraryMediaCounts(txn, libraryIdInt, id)
+				if err != nil {
+					return err
+				}
+				waitDays := float64(counts.EstimatedWaitDays)
+				if counts.AvailableCount > 0 {
+					recommendation.AvailableNow++
+					waitDays = 0
+				}
+				totalWait += max(waitDays, 0)
+				recommendation.Score += waitWeight(waitDays)
+			}
+			recommendation.WaitDays = totalWait / float64(len(recommendation.MediaIds))
+			recommendations = append(recommendations, recommendation)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read wishlist availability")
+		http.Error(w, "failed to read wishlist availability", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(recommendations, func(i, j int) bool {
+		if recommendations[i].Score != recommendations[j].Score {
+			return recommendations[i].Score > recommendations[j].Score
+		}
+		return recommendations[i].Library.Id < recommendations[j].Library.Id
+	})
+	if len(recommendations) > limit {
+		recommendations = recommendations[:limit]
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(RecommendLibraryResponse{
+		Libraries:       libraries,
+		Wishlist:        wishlist.GetCardinality(),
+		Missing:         missing.GetCardinality(),
+		Recommendations: recommendations,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode library recommendations")
+	}
+}
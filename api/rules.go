@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// library rules decide which libraries every handler shows and how they're
+// labelled. they come from the admin endpoint (stored under the lr key), else
+// from cfg.LibraryRulesFile, else defaultLibraryRules
+
+const (
+	libraryKindLibrary = "library"
+	libraryKindRetail  = "retail"
+	libraryKindKindle  = "kindle"
+)
+
+type LibraryRule struct {
+	LibraryId string `json:"libraryId" yaml:"libraryId"`
+	Hide      bool   `json:"hide,omitempty" yaml:"hide,omitempty"`
+	Kind      string `json:"kind,omitempty" yaml:"kind,omitempty"`
+	Region    string `json:"region,omitempty" yaml:"region,omitempty"`
+}
+
+type LibraryRules struct {
+	Rules []LibraryRule `json:"rules" yaml:"rules"`
+	// Regions restricts the visible libraries to the ones with a rule placing them in one of these regions
+	Regions []string `json:"regions,omitempty" yaml:"regions,omitempty"`
+}
+
+var libraryRulesKey = []byte("lr")
+
+var libraryRules atomic.Pointer[LibraryRules]
+
+func defaultLibraryRules() *LibraryRules {
+	return &LibraryRules{
+		Rules: []LibraryRule{
+			{LibraryId: "uskindle", Hide: true, Kind: libraryKindKindle},
+		},
+	}
+}
+
+func (rules *LibraryRules) Validate() error {
+	seen := map[string]bool{}
+	for _, rule := range rules.Rules {
+		if rule.LibraryId == "" {
+			return errors.New("rule without libraryId")
+		}
+		if seen[rule.LibraryId] {
+			return fmt.Errorf("duplicate rule for %q", rule.LibraryId)
+		}
+		seen[rule.LibraryId] = true
+		switch rule.Kind {
+		case "", libraryKindLibrary, libraryKindRetail, libraryKindKindle:
+		default:
+			return fmt.Errorf("invalid kind %q for %q", rule.Kind, rule.LibraryId)
+		}
+	}
+	return nil
+}
+
+// apply returns the library labelled by its rule and whether it's visible
+func (rules *LibraryRules) apply(library Library) (Library, bool) {
+	var rule LibraryRule
+	for _, candidate := range rules.Rules {
+		if candidate.LibraryId == library.Id {
+			rule = candidate
+			break
+		}
+	}
+	library.Kind = rule.Kind
+	if library.Kind == "" {
+		library.Kind = libraryKindLibrary
+	}
+	library.Region = rule.Region
+	if rule.Hide {
+		return library, false
+	}
+	if len(rules.Regions) > 0 && !slices.Contains(rules.Regions, rule.Region) {
+		return library, false
+	}
+	return library, true
+}
+
+// loadLibraryRules picks the stored rules, the rules file or the defaults
+func loadLibraryRules() error {
+	var rules *LibraryRules
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(libraryRulesKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			rules = &LibraryRules{}
+			return json.Unmarshal(val, rules)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("reading stored library rules: %w", err)
+	}
+	source := "admin"
+	if rules == nil && cfg.LibraryRulesFile != "" {
+		source = cfg.LibraryRulesFile
+		buf, err := os.ReadFile(cfg.LibraryRulesFile)
+		if err != nil {
+			return fmt.Errorf("reading library rules: %w", err)
+		}
+		rules = &LibraryRules{}
+		if err := yaml.Unmarshal(buf, rules); err != nil {
+			return fmt.Errorf("parsing %s: %w", cfg.LibraryRulesFile, err)
+		}
+	}
+	if rules == nil {
+		source = "default"
+		rules = defaultLibraryRules()
+	}
+	if err := rules.Validate(); err != nil {
+		return fmt.Errorf("invalid library rules from %s: %w", source, err)
+	}
+	libraryRules.Store(rules)
+	log.Info().Str("source", source).Int("rules", len(rules.Rules)).Msg("loaded library rules")
+	return nil
+}
+
+// libraryVisibility is a generation seen through the library rules, it's
+// rebuilt when the rules change
+type libraryVisibility struct {
+	rules *LibraryRules
+	// libraries holds the visible libraries with their kind and region
+	libraries map[uint16]Library
+	// unique is the media owned by exactly one visible library
+	unique *roaring.Bitmap
+	// similar caches the most similar libraries, uint16 -> []SimilarLibrary
+	similar sync.Map
+}
+
+func (g *generation) visibility() *libraryVisibility {
+	rules := libraryRules.Load()
+	if v := g.visible.Load(); v != nil && v.rules == rules {
+		return v
+	}
+	g.visibleMutex.Lock()
+	defer g.visibleMutex.Unlock()
+	if v := g.visible.Load(); v != nil && v.rules == rules {
+		return v
+	}
+	v := &libraryVisibility{
+		rules:     rules,
+		libraries: map[uint16]Library{},
+	}
+	once := roaring.New()
+	twice := roaring.New()
+	for libraryIdInt, library := range g.libraryMap {
+		library, visible := rules.apply(library)
+		if !visible {
+			continue
+		}
+		v.libraries[libraryIdInt] = library
+		bitmap := g.libraryBitmap(libraryIdInt)
+		twice.Or(roaring.And(once, bitmap))
+		once.Or(bitmap)
+	}
+	once.AndNot(twice)
+	once.RunOptimize()
+	v.unique = once
+	g.visible.Store(v)
+	return v
+}
+
+// library returns a visible library, labelled by the rules
+func (g *generation) library(libraryIdInt uint16) (Library, bool) {
+	library, exists := g.visibility().libraries[libraryIdInt]
+	return library, exists
+}
+
+func libraryRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodPut {
+		rules := &LibraryRules{}
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(rules); err != nil {
+			http.Error(w, "invalid library rules: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := rules.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		buf, err := json.Marshal(rules)
+		if err == nil {
+			err = db.Update(func(txn *badger.Txn) error {
+				return txn.Set(libraryRulesKey, buf)
+			})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to store library rules")
+			http.Error(w, "failed to store library rules", http.StatusInternalServerError)
+			return
+		}
+		libraryRules.Store(rules)
+		log.Info().Int("rules", len(rules.Rules)).Msg("updated library rules")
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(libraryRules.Load())
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode library rules")
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// saved queries give a search, diff, intersect, unique or compare query a
+// short code. the code is a permalink, running it re-runs the query against
+// the current generation. queries with trackCounts have their result count
+// recorded after every load:
+//
+//	sq<code> -> saved query json
+//	sc<code><day uint16> -> result count uint64, pruned with the history
+//
+// the editKey returned on create is needed to delete the query
+
+const (
+	savedQueryCodeLength = 8
+	savedQueryCodeChars  = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	maxSavedQueryName    = 200
+)
+
+// savedQueryParams are the query params each kind keeps and the handler that answers it
+var savedQueryParams = map[string]struct {
+	required []string
+	optional []string
+	handler  http.HandlerFunc
+}{
+	"search":    {required: []string{"q"}, handler: searchHandler},
+	"diff":      {required: []string{"leftLibraryId", "rightLibraryId"}, optional: []string{"includeConsortium"}, handler: diffHandler},
+	"intersect": {required: []string{"leftLibraryId", "rightLibraryId"}, handler: intersectHandler},
+	"unique":    {required: []string{"libraryId"}, optional: []string{"includeConsortium"}, handler: uniqueHandler},
+	"compare":   {required: []string{"expr"}, handler: compareHandler},
+}
+
+// savedQueryRunParams are passed through from the run request, they pick the page and the format
+var savedQueryRunParams = []string{"offset", "limit", "format"}
+
+type SavedQuery struct {
+	Code        string            `json:"code"`
+	Name        string            `json:"name"`
+	Kind        string            `json:"kind"`
+	Params      map[string]string `json:"params"`
+	TrackCounts bool              `json:"trackCounts"`
+	// EditKey is only returned when the query is created
+	EditKey string    `json:"editKey,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type SavedQueryRequest struct {
+	Name        string            `json:"name"`
+	Kind        string            `json:"kind"`
+	Params      map[string]string `json:"params"`
+	TrackCounts bool              `json:"trackCounts"`
+}
+
+type SavedQueryCount struct {
+	Date  string `json:"date"`
+	Total uint64 `json:"total"`
+}
+
+type SavedQueryResponse struct {
+	*SavedQuery
+	// Total is the result count against the current data
+	Total  uint64            `json:"total"`
+	Counts []SavedQueryCount `json:"counts"`
+}
+
+func getSavedQueryKey(code string) []byte {
+	return append([]byte("sq"), code...)
+}
+
+func getSavedQueryCountPrefix(code string) []byte {
+	return append([]byte("sc"), code...)
+}
+
+func getSavedQueryCountKey(code string, day uint16) []byte {
+	return binary.BigEndian.AppendUint16(getSavedQueryCountPrefix(code), day)
+}
+
+func newSavedQueryCode() (string, error) {
+	buf := make([]byte, savedQueryCodeLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = savedQueryCodeChars[int(b)%len(savedQueryCodeChars)]
+	}
+	return string(buf), nil
+}
+
+func (request *SavedQueryRequest) validate(g *generation) error {
+	if request.Name == "" || len(request.Name) > maxSavedQueryName {
+		return fmt.Errorf("name needs 1 to %d characters", maxSavedQueryName)
+	}
+	kind, exists := savedQueryParams[request.Kind]
+	if !exists {
+		return fmt.Errorf("invalid kind %q", request.Kind)
+	}
+	for param := range request.Params {
+		if !slices.Contains(kind.required, param) && !slices.Contains(kind.optional, param) {
+			return fmt.Errorf("invalid param %q for %s", param, request.Kind)
+		}
+	}
+	for _, param := range kind.required {
+		if request.Params[param] == "" {
+			return fmt.Errorf("missing param %q", param)
+		}
+	}
+	// counting runs the query, which checks the libraries and expressions
+	_, err := g.savedQueryTotal(&SavedQuery{Kind: request.Kind, Params: request.Params})
+	return err
+}
+
+// savedQueryTotal counts the results of a saved query in g
+func (g *generation) savedQueryTotal(query *SavedQuery) (uint64, error) {
+	params := query.Params
+	withConsortium := params["includeConsortium"] == "true"
+	lookup := func(param string) (uint16, error) {
+		libraryIdInt, _, exists := g.lookupLibrary(params[param])
+		if !exists {
+			return 0, fmt.Errorf("invalid library id %q", params[param])
+		}
+		return libraryIdInt, nil
+	}
+	switch query.Kind {
+	case "search":
+		// counted like the search endpoint returns them
+		return uint64(min(len(g.search.Search(params["q"])), maxSearchResults)), nil
+	case "diff", "intersect":
+		leftLibraryIdInt, err := lookup("leftLibraryId")
+		if err != nil {
+			return 0, err
+		}
+		rightLibraryIdInt, err := lookup("rightLibraryId")
+		if err != nil {
+			return 0, err
+		}
+		if query.Kind == "diff" {
+			return g.diffBitmap(leftLibraryIdInt, rightLibraryIdInt, withConsortium).GetCardinality(), nil
+		}
+		return g.intersectBitmap(leftLibraryIdInt, rightLibraryIdInt).GetCardinality(), nil
+	case "unique":
+		libraryIdInt, err := lookup("libraryId")
+		if err != nil {
+			return 0, err
+		}
+		return g.libraryUniqueBitmap(libraryIdInt, withConsortium).GetCardinality(), nil
+	case "compare":
+		e, _, err := g.parseCompareExpr(params["expr"])
+		if err != nil {
+			return 0, err
+		}
+		return e.eval(g).GetCardinality(), nil
+	}
+	return 0, fmt.Errorf("invalid kind %q", query.Kind)
+}
+
+func readSavedQuery(txn *badger.Txn, code string) (*SavedQuery, error) {
+	item, err := txn.Get(getSavedQueryKey(code))
+	if err != nil {
+		return nil, err
+	}
+	query := &SavedQuery{}
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, query)
+	})
+	return query, err
+}
+
+func encodeSavedQueryCount(total uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, total)
+}
+
+func readSavedQueryCounts(txn *badger.Txn, code string) ([]SavedQueryCount, error) {
+	counts := []SavedQueryCount{}
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = getSavedQueryCountPrefix(code)
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		day := binary.BigEndian.Uint16(item.Key()[len(item.Key())-2:])
+		err := item.Value(func(val []byte) error {
+			counts = append(counts, SavedQueryCount{Date: dayToDate(day), Total: binary.BigEndian.Uint64(val)})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// recordSavedQueryCounts stores the result count of every tracked query for
+// the current snapshot, a reload on the same day replaces the count
+func recordSavedQueryCounts() {
+	g := acquireGeneration()
+	defer g.release()
+	day, err := snapshotDay()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to record saved query counts")
+		return
+	}
+	start := time.Now()
+	var queries []*SavedQuery
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("sq")
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			query := &SavedQuery{}
+			err := iter.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, query)
+			})
+			if err != nil {
+				return err
+			}
+			if query.TrackCounts {
+				queries = append(queries, query)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read saved queries")
+		return
+	}
+	writeBatch := db.NewWriteBatch()
+	recorded := 0
+	for _, query := range queries {
+		total, err := g.savedQueryTotal(query)
+		if err != nil {
+			// a library of the query was removed or hidden since it was saved
+			log.Debug().Err(err).Str("code", query.Code).Msg("skipping saved query count")
+			continue
+		}
+		err = writeBatch.Set(getSavedQueryCountKey(query.Code, day), encodeSavedQueryCount(total))
+		if err != nil {
+			writeBatch.Cancel()
+			log.Error().Err(err).Msg("failed to record saved query counts")
+			return
+		}
+		recorded++
+	}
+	if err := writeBatch.Flush(); err != nil {
+		log.Error().Err(err).Msg("failed to record saved query counts")
+		return
+	}
+	log.Info().Uint32("generation", g.id).Int("queries", recorded).Dur("duration", time.Since(start)).
+		Msg("recorded saved query counts")
+}
+
+func createSavedQueryHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	var request SavedQueryRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "invalid saved query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := &SavedQuery{
+		Name:        request.Name,
+		Kind:        request.Kind,
+		Params:      request.Params,
+		TrackCounts: request.TrackCounts,
+		Created:     time.Now().UTC(),
+	}
+	total, _ := g.savedQueryTotal(query)
+	day, err := snapshotDay()
+	if err == nil {
+		query.EditKey, err = randomHex(16)
+	}
+	if err == nil {
+		err = db.Update(func(txn *badger.Txn) error {
+			// codes are short, draw again on the rare collision
+			for {
+				code, err := newSavedQueryCode()
+				if err != nil {
+					return err
+				}
+				_, err = txn.Get(getSavedQueryKey(code))
+				if errors.Is(err, badger.ErrKeyNotFound) {
+					query.Code = code
+					break
+				}
+				if err != nil {
+					return err
+				}
+			}
+			buf, err := json.Marshal(query)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(getSavedQueryKey(query.Code), buf); err != nil {
+				return err
+			}
+			if query.TrackCounts {
+				return txn.Set(getSavedQueryCountKey(query.Code, day), encodeSavedQueryCount(total))
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to save query")
+		http.Error(w, "failed to save query", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("code", query.Code).Str("kind", query.Kind).Msg("POST /api/saved")
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(SavedQueryResponse{
+		SavedQuery: query,
+		Total:      total,
+		Counts:     []SavedQueryCount{},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode saved query")
+	}
+}
+
+// getSavedQueryHandler returns a saved query with its count against the
+// current data and, when tracked, the counts of earlier loads
+func getSavedQueryHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	code := r.URL.Query().Get("code")
+	var query *SavedQuery
+	var counts []SavedQueryCount
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		query, err = readSavedQuery(txn, code)
+		if err != nil {
+			return err
+		}
+		counts, err = readSavedQueryCounts(txn, code)
+		return err
+	})
+	if code == "" || errors.Is(err, badger.ErrKeyNotFound) {
+		http.Error(w, "saved query not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read saved query")
+		http.Error(w, "failed to read saved query", http.StatusInternalServerError)
+		return
+	}
+	total, err := g.savedQueryTotal(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.EditKey = ""
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(SavedQueryResponse{
+		SavedQuery: query,
+		Total:      total,
+		Counts:     counts,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode saved query")
+	}
+}
+
+// runSavedQueryHandler answers a saved query like its endpoint would, with
+// the saved params and the page and format of the request
+func runSavedQueryHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("code")
+	var query *SavedQuery
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		query, err = readSavedQuery(txn, code)
+		return err
+	})
+	if code == "" || errors.Is(err, badger.ErrKeyNotFound) {
+		http.Error(w, "saved query not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read saved query")
+		http.Error(w, "failed to read saved query", http.StatusInternalServerError)
+		return
+	}
+	kind, exists := savedQueryParams[query.Kind]
+	if !exists {
+		http.Error(w, "invalid saved query", http.StatusInternalServerError)
+		return
+	}
+	params := url.Values{}
+	for param, value := range query.Params {
+		params.Set(param, value)
+	}
+	for _, param := range savedQueryRunParams {
+		if value := r.URL.Query().Get(param); value != "" {
+			params.Set(param, value)
+		}
+	}
+	run := r.Clone(r.Context())
+	run.URL.RawQuery = params.Encode()
+	log.Info().Str("code", code).Str("kind", query.Kind).Msg("/api/saved/run")
+	kind.handler(w, run)
+}
+
+func deleteSavedQueryHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("code")
+	err := db.View(func(txn *badger.Txn) error {
+		query, err := readSavedQuery(txn, code)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(query.EditKey), []byte(r.URL.Query().Get("key"))) != 1 {
+			return errSavedQueryKey
+		}
+		return nil
+	})
+	if code == "" || errors.Is(err, badger.ErrKeyNotFound) {
+		http.Error(w, "saved query not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errSavedQueryKey) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err == nil {
+		err = deleteKeysWithPrefix(getSavedQueryKey(code), getSavedQueryCountPrefix(code))
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to delete saved query")
+		http.Error(w, "failed to delete saved query", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("code", code).Msg("DELETE /api/saved")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errSavedQueryKey = errors.New("invalid edit key")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"github.com/RoaringBitmap/roaring"
@@ -19,6 +20,9 @@ import (
 	"unicode"
 )
 
+// maxSearchResults caps the results of /api/search
+const maxSearchResults = 500
+
 type SearchIndex struct {
 	sync.RWMutex
 	ngramMap     map[string]*ConcurrentBitmap
@@ -39,10 +43,9 @@ type SearchResult struct {
 	LibraryCount    int            `json:"libraryCount"`
 	Languages       []string       `json:"languages"`
 	Formats         []string       `json:"formats"`
+	Isbns           []string       `json:"isbns"`
 }
 
-var search = NewSearchIndex()
-
 var ngramIDQueues = &sync.Map{}
 
 func NewSearchIndex() *SearchIndex {
@@ -237,16 +240,31 @@ func getNgrams(s string) []string {
 	return uniqueNgrams
 }
 
-func NewSearchResult(media *Media) *SearchResult {
+// NewSearchResult builds the search result of media in a read transaction of its own
+func (g *generation) NewSearchResult(media *Media) *SearchResult {
+	var result *SearchResult
+	err := db.View(func(txn *badger.Txn) error {
+		result = g.NewSearchResultTxn(txn, media)
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Uint32("id", media.Id).Msg("failed to build search result")
+	}
+	return result
+}
+
+// NewSearchResultTxn builds the search result of media in txn, for handlers
+// that already read in a transaction
+func (g *generation) NewSearchResultTxn(txn *badger.Txn, media *Media) *SearchResult {
 	var formats []string
 	var languages []string
-	formatMap.Range(func(format, bitmap interface{}) bool {
+	g.formatMap.Range(func(format, bitmap interface{}) bool {
 		if bitmap.(*ConcurrentBitmap).Contains(media.Id) {
 			formats = append(formats, format.(string))
 		}
 		return true
 	})
-	languageMap.Range(func(language, bitmap interface{}) bool {
+	g.languageMap.Range(func(language, bitmap interface{}) bool {
 		if bitmap.(*ConcurrentBitmap).Contains(media.Id) {
 			languages = append(languages, language.(string))
 		}
@@ -258,19 +276,19 @@ func NewSearchResult(media *Media) *SearchResult {
 	coverUrl := media.CoverUrl
 	description := media.Description
 	libraryCount := 0
-	err := db.View(func(txn *badger.Txn) error {
-		prefix := getMediaAvailabilityPrefix(media.Id)
-		opts := badger.DefaultIteratorOptions
-		opts.Prefix = prefix
-		iter := txn.NewIterator(opts)
-		defer iter.Close()
-		for iter.Rewind(); iter.Valid(); iter.Next() {
+	prefix := g.getMediaAvailabilityPrefix(media.Id)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+	visible := g.visibility().libraries
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		// libraries hidden by the library rules aren't counted
+		libraryIdInt := binary.BigEndian.Uint16(g.trimNamespace(iter.Item().Key())[6:])
+		if _, exists := visible[libraryIdInt]; exists {
 			libraryCount++
 		}
-		return nil
-	})
-	if err != nil {
-		log.Err(err)
 	}
 	result := &SearchResult{
 		Id:              media.Id,
@@ -286,30 +304,50 @@ func NewSearchResult(media *Media) *SearchResult {
 		SeriesReadOrder: media.SeriesReadOrder,
 		Publisher:       media.Publisher,
 		PublisherId:     media.PublisherId,
+		Isbns:           getIsbns(media.Ids),
 	}
 	return result
 }
 
 func searchHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
 	query := r.URL.Query().Get("q")
+	format, err := parseExportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	log.Debug().Msgf("/api/search q: %v", query)
 	startTime := time.Now()
 	var results []*SearchResult
-	ids := search.Search(query)
+	ids := g.search.Search(query)
 	for _, id := range ids {
-		media, _ := getMedia(id)
-		searchResult := NewSearchResult(media)
+		media, _ := g.getMedia(id)
+		searchResult := g.NewSearchResult(media)
 		results = append(results, searchResult)
-		if len(results) >= 500 {
+		if len(results) >= maxSearchResults {
 			break
 		}
 	}
-	result := map[string][]*SearchResult{}
-	result["results"] = results
-	w.Header().Add("Content-Type", "application/json")
-	err := json.NewEncoder(w).Encode(result)
-	if err != nil {
-		log.Error().Err(err)
+	if format != "" {
+		table, err := newTableWriter(w, format, "search")
+		for _, searchResult := range results {
+			if err != nil {
+				break
+			}
+			err = writeExportRows(table, searchResult.exportRows(g))
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to write search export")
+		}
+	} else {
+		result := map[string][]*SearchResult{}
+		result["results"] = results
+		w.Header().Add("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(result)
+		if err != nil {
+			log.Error().Err(err)
+		}
 	}
 	log.Info().Int("results", len(results)).
 		Str("duration", fmt.Sprintf("%dms", time.Since(startTime)/time.Millisecond)).
@@ -317,6 +355,7 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func searchDebugHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
 	ngram := r.URL.Query().Get("ngram")
 	mediaId := r.URL.Query().Get("mediaId")
 	mediaIdInt, err := strconv.Atoi(mediaId)
@@ -325,7 +364,7 @@ func searchDebugHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Debug().Msgf("/api/search-debug: ngram %v, mediaId %v", ngram, mediaId)
 	result := map[string]bool{}
-	bitmap, exists := search.Get(ngram)
+	bitmap, exists := g.search.Get(ngram)
 	if !exists {
 		result["ngramBitmapExists"] = false
 		w.Header().Add("Content-Type", "application/json")
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// similarLibrariesKept is how many of the most similar libraries are kept per library
+	similarLibrariesKept = 100
+	// maxOverlapLibraries bounds the overlap matrix, it compares every pair
+	maxOverlapLibraries = 50
+)
+
+// LibraryOverlap compares the collection of a library with another one
+type LibraryOverlap struct {
+	Shared uint64 `json:"shared"`
+	// Jaccard is shared titles over the titles of both libraries together
+	Jaccard float64 `json:"jaccard"`
+	// Overlap is shared titles over the titles of the smaller library
+	Overlap float64 `json:"overlap"`
+	// NewTitles is the number of titles the other library adds
+	NewTitles uint64 `json:"newTitles"`
+}
+
+type SimilarLibrary struct {
+	Library Library `json:"library"`
+	LibraryOverlap
+}
+
+type SimilarLibrariesResponse struct {
+	Library Library          `json:"library"`
+	Similar []SimilarLibrary `json:"similar"`
+}
+
+type OverlapResponse struct {
+	Libraries []Library `json:"libraries"`
+	// Matrix[i][j] compares Libraries[i] with Libraries[j]
+	Matrix [][]LibraryOverlap `json:"matrix"`
+}
+
+func (g *generation) libraryOverlap(libraryIdInt, otherIdInt uint16) LibraryOverlap {
+	owned := g.libraryBitmap(libraryIdInt)
+	other := g.libraryBitmap(otherIdInt)
+	shared := owned.AndCardinality(other)
+	overlap := LibraryOverlap{
+		Shared:    shared,
+		NewTitles: other.GetCardinality() - shared,
+	}
+	if union := owned.OrCardinality(other); union > 0 {
+		overlap.Jaccard = float64(shared) / float64(union)
+	}
+	if smaller := min(owned.GetCardinality(), other.GetCardinality()); smaller > 0 {
+		overlap.Overlap = float64(shared) / float64(smaller)
+	}
+	return overlap
+}
+
+// similarLibraries returns the libraries with the highest jaccard score, they
+// are computed on first use and kept for the generation
+func (g *generation) similarLibraries(libraryIdInt uint16) []SimilarLibrary {
+	v := g.visibility()
+	if similar, exists := v.similar.Load(libraryIdInt); exists {
+		return similar.([]SimilarLibrary)
+	}
+	similar := make([]SimilarLibrary, 0, len(v.libraries))
+	for otherIdInt, other := range v.libraries {
+		if otherIdInt == libraryIdInt {
+			continue
+		}
+		overlap := g.libraryOverlap(libraryIdInt, otherIdInt)
+		if overlap.Shared == 0 {
+			continue
+		}
+		similar = append(similar, SimilarLibrary{Library: other, LibraryOverlap: overlap})
+	}
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].Jaccard != similar[j].Jaccard {
+			return similar[i].Jaccard > similar[j].Jaccard
+		}
+		return similar[i].Library.Id < similar[j].Library.Id
+	})
+	if len(similar) > similarLibrariesKept {
+		similar = similar[:similarLibrariesKept]
+	}
+	v.similar.Store(libraryIdInt, similar)
+	return similar
+}
+
+// precomputeSimilarity fills the similar libraries of every library in the
+// background so requests don't pay for it, it stops when g is replaced
+func (g *generation) precomputeSimilarity() {
+	start := time.Now()
+	libraries := g.visibility().libraries
+	for libraryIdInt := range libraries {
+		if g.retired.Load() {
+			return
+		}
+		g.similarLibraries(libraryIdInt)
+	}
+	log.Info().Uint32("generation", g.id).Int("libraries", len(libraries)).
+		Dur("duration", time.Since(start)).
+		Msg("precomputed library similarity")
+}
+
+func similarLibrariesHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	libraryIdInt, library, exists := g.lookupLibrary(r.URL.Query().Get("libraryId"))
+	if !exists {
+		http.Error(w, "invalid library id", http.StatusBadRequest)
+		return
+	}
+	limit := 20
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	filter, err := parseLibraryFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Info().Msgf("/api/library/similar libraryId %s", library.Id)
+	similar := g.similarLibraries(libraryIdInt)
+	if filter != (libraryFilter{}) {
+		similar = slices.DeleteFunc(slices.Clone(similar), func(similar SimilarLibrary) bool {
+			return !filter.matches(similar.Library)
+		})
+	}
+	if len(similar) > limit {
+		similar = similar[:limit]
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(SimilarLibrariesResponse{
+		Library: library,
+		Similar: similar,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode similar libraries")
+	}
+}
+
+func overlapHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	libraryIds := r.URL.Query()["libraryId"]
+	if len(libraryIds) < 2 {
+		http.Error(w, "at least two libraryId are required", http.StatusBadRequest)
+		return
+	}
+	if len(libraryIds) > maxOverlapLibraries {
+		http.Error(w, fmt.Sprintf("at most %d libraryId can be compared", maxOverlapLibraries), http.StatusBadRequest)
+		return
+	}
+	libraryIdInts := make([]uint16, 0, len(libraryIds))
+	libraries := make([]Library, 0, len(libraryIds))
+	for _, libraryId := range libraryIds {
+		libraryIdInt, library, exists := g.lookupLibrary(libraryId)
+		if !exists {
+			http.Error(w, "invalid library id "+libraryId, http.StatusBadRequest)
+			return
+		}
+		libraryIdInts = append(libraryIdInts, libraryIdInt)
+		libraries = append(libraries, library)
+	}
+	log.Info().Msgf("/api/overlap libraryIds %v", libraryIds)
+	matrix := make([][]LibraryOverlap, len(libraryIdInts))
+	for i, libraryIdInt := range libraryIdInts {
+		matrix[i] = make([]LibraryOverlap, len(libraryIdInts))
+		for j, otherIdInt := range libraryIdInts {
+			matrix[i][j] = g.libraryOverlap(libraryIdInt, otherIdInt)
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(OverlapResponse{
+		Libraries: libraries,
+		Matrix:    matrix,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode overlap")
+	}
+}
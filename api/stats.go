@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// LibraryStats summarizes the collection of one library, computed once per generation
+type LibraryStats struct {
+	TotalTitles     uint64            `json:"totalTitles"`
+	TotalCopies     uint64            `json:"totalCopies"`
+	AvailableCopies uint64            `json:"availableCopies"`
+	TotalHolds      uint64            `json:"totalHolds"`
+	UniqueTitles    uint64            `json:"uniqueTitles"`
+	Formats         map[string]uint64 `json:"formats"`
+	Languages       map[string]uint64 `json:"languages"`
+	// AvailableShare is the share of copies that can be borrowed right now
+	AvailableShare float64 `json:"availableShare"`
+	// HoldsToCopies is the number of holds per owned copy
+	HoldsToCopies  float64 `json:"holdsToCopies"`
+	MedianWaitDays int16   `json:"medianWaitDays"`
+}
+
+type LibraryStatsResponse struct {
+	Library Library       `json:"library"`
+	Stats   *LibraryStats `json:"stats"`
+}
+
+// buildLibraryStats scans the la keys once and fills g.libraryStats, it needs
+// the ownership bitmaps for the language counts
+func (g *generation) buildLibraryStats() error {
+	start := time.Now()
+	stats := map[uint16]*LibraryStats{}
+	waits := map[uint16][]int16{}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = g.key([]byte("la"))
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			libraryIdInt := binary.BigEndian.Uint16(g.trimNamespace(item.Key())[2:])
+			libraryStats, exists := stats[libraryIdInt]
+			if !exists {
+				libraryStats = &LibraryStats{
+					Formats:   map[string]uint64{},
+					Languages: map[string]uint64{},
+				}
+				stats[libraryIdInt] = libraryStats
+			}
+			err := item.Value(func(val []byte) error {
+				counts, err := g.decodeLibraryMediaCounts(libraryIdInt, val)
+				if err != nil {
+					return err
+				}
+				libraryStats.TotalTitles++
+				libraryStats.TotalCopies += uint64(counts.OwnedCount)
+				libraryStats.AvailableCopies += uint64(counts.AvailableCount)
+				libraryStats.TotalHolds += uint64(counts.HoldsCount)
+				for _, formatInt := range counts.Formats {
+					libraryStats.Formats[g.formatReverseMap[formatInt]]++
+				}
+				waits[libraryIdInt] = append(waits[libraryIdInt], counts.EstimatedWaitDays)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	languages := map[string]*roaring.Bitmap{}
+	g.languageMap.Range(func(language, bitmap interface{}) bool {
+		languages[language.(string)] = bitmap.(*ConcurrentBitmap).Clone()
+		return true
+	})
+	for libraryIdInt, libraryStats := range stats {
+		owned := g.libraryBitmap(libraryIdInt)
+		for language, bitmap := range languages {
+			if count := owned.AndCardinality(bitmap); count > 0 {
+				libraryStats.Languages[language] = count
+			}
+		}
+		if libraryStats.TotalCopies > 0 {
+			libraryStats.AvailableShare = float64(libraryStats.AvailableCopies) / float64(libraryStats.TotalCopies)
+			libraryStats.HoldsToCopies = float64(libraryStats.TotalHolds) / float64(libraryStats.TotalCopies)
+		}
+		libraryStats.MedianWaitDays = median(waits[libraryIdInt])
+	}
+	g.libraryStats = stats
+	log.Info().Int("libraries", len(stats)).Dur("duration", time.Since(start)).Msg("built library stats")
+	return nil
+}
+
+func median(values []int16) int16 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return int16((int(values[middle-1]) + int(values[middle])) / 2)
+	}
+	return values[middle]
+}
+
+// getLibraryStats returns the stats of a library, empty ones when it owns nothing.
+// unique titles depend on which libraries are visible so they're counted here
+func (g *generation) getLibraryStats(libraryIdInt uint16) *LibraryStats {
+	stats := LibraryStats{
+		Formats:   map[string]uint64{},
+		Languages: map[string]uint64{},
+	}
+	if precomputed, exists := g.libraryStats[libraryIdInt]; exists {
+		stats = *precomputed
+	}
+	stats.UniqueTitles = g.libraryBitmap(libraryIdInt).AndCardinality(g.visibility().unique)
+	return &stats
+}
+
+func libraryStatsHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	libraryIdInt, library, exists := g.lookupLibrary(r.URL.Query().Get("libraryId"))
+	if !exists {
+		http.Error(w, "invalid library id", http.StatusBadRequest)
+		return
+	}
+	log.Info().Msgf("/api/library/stats libraryId %s", library.Id)
+	w.Header().Add("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(LibraryStatsResponse{
+		Library: library,
+		Stats:   g.getLibraryStats(libraryIdInt),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode library stats")
+	}
+}
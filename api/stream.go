@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// wantsNDJSON reports whether the client asked for one json record per line
+func wantsNDJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// recordWriter collects the records of a comparison for a single json response,
+// or when the client accepts ndjson (or asked for format=csv/tsv) writes and
+// flushes every record as it's produced. the total is sent in the X-Total-Count
+// header when streaming, name is the file name of csv/tsv downloads
+type recordWriter[T exportable] struct {
+	w         http.ResponseWriter
+	ctx       context.Context
+	g         *generation
+	streaming bool
+	encoder   *json.Encoder
+	table     *csv.Writer
+	flusher   http.Flusher
+	records   []T
+	written   int
+}
+
+// newRecordWriter expects the format to be checked with parseExportFormat already
+func newRecordWriter[T exportable](w http.ResponseWriter, r *http.Request, total uint64, name string) *recordWriter[T] {
+	rw := &recordWriter[T]{
+		w:       w,
+		ctx:     r.Context(),
+		g:       requestGeneration(r),
+		records: []T{},
+	}
+	format, _ := parseExportFormat(r)
+	switch {
+	case format != "":
+		rw.streaming = true
+		var err error
+		rw.table, err = newTableWriter(w, format, name)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to write table header")
+		}
+	case wantsNDJSON(r):
+		rw.streaming = true
+		w.Header().Set("Content-Type", ndjsonContentType)
+		rw.encoder = json.NewEncoder(w)
+	}
+	if rw.streaming {
+		w.Header().Set("X-Total-Count", strconv.FormatUint(total, 10))
+		rw.flusher, _ = w.(http.Flusher)
+	}
+	return rw
+}
+
+// Write adds a record, it fails once the client has gone away so the caller stops working
+func (rw *recordWriter[T]) Write(record T) error {
+	if err := rw.ctx.Err(); err != nil {
+		return err
+	}
+	if !rw.streaming {
+		rw.records = append(rw.records, record)
+		return nil
+	}
+	var err error
+	if rw.table != nil {
+		err = writeExportRows(rw.table, record.exportRows(rw.g))
+	} else {
+		err = rw.encoder.Encode(record)
+	}
+	if err != nil {
+		return err
+	}
+	rw.written++
+	if rw.flusher != nil {
+		rw.flusher.Flush()
+	}
+	return nil
+}
+
+func (rw *recordWriter[T]) Streaming() bool {
+	return rw.streaming
+}
+
+// Fail reports an error that stopped the records, once streaming has started
+// the status can't change anymore so it's only logged
+func (rw *recordWriter[T]) Fail(err error, msg string) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		log.Info().Int("written", rw.written).Msg("client went away, " + msg)
+		return
+	}
+	log.Error().Err(err).Int("written", rw.written).Msg(msg)
+	if rw.written == 0 {
+		http.Error(rw.w, msg, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/dgraph-io/badger/v4"
+	"math"
+	"strings"
+)
+
+// the wait of a new hold is estimated from the queue ahead of it, the copies
+// serving it and how long a loan lasts. the data source's estimatedWaitDays is
+// only kept when the counts can't be modelled (no copies). once the history has
+// a few snapshots, the speed the queue was observed to move at is blended in
+
+const (
+	// ebookLoanDays and audiobookLoanDays are the loan periods used when the library's policy has none
+	ebookLoanDays     = 14
+	audiobookLoanDays = 21
+	// earlyReturnShare is the share of the loan period a loan lasts on average,
+	// patrons return early and some holds are passed on
+	earlyReturnShare = 0.75
+	// fastReturnShare bounds the low end of the range, every loan returned at half of the period
+	fastReturnShare = 0.5
+	// minVelocitySnapshots is how many history snapshots are needed before the
+	// observed queue velocity is used
+	minVelocitySnapshots = 2
+)
+
+// WaitEstimate is a wait in days with its confidence range, Low <= Days <= High
+type WaitEstimate struct {
+	Days int16
+	Low  int16
+	High int16
+}
+
+// WaitInput holds what the wait of a title at a library is estimated from
+type WaitInput struct {
+	Owned     uint16
+	Available uint16
+	Holds     uint16
+	// LoanDays is the loan period of the library for the title's format
+	LoanDays int
+	// Velocity is how many holds per day the queue was observed to serve, 0 without history
+	Velocity float64
+	// Reported is the data source's estimate, used when the counts can't be modelled
+	Reported int16
+}
+
+func clampWaitDays(days float64) int16 {
+	return int16(min(max(math.Round(days), 0), math.MaxInt16))
+}
+
+// estimateWait estimates the wait of a hold placed now. it's a pure function
+// of its input so it can be checked against fixture counts
+func estimateWait(input WaitInput) WaitEstimate {
+	if input.Available > input.Holds {
+		return WaitEstimate{}
+	}
+	if input.Owned == 0 || input.LoanDays <= 0 {
+		reported := max(input.Reported, 0)
+		return WaitEstimate{Days: reported, Low: reported, High: reported}
+	}
+	// a new hold is served after everyone ahead of it, the available copies
+	// already go to the first holds in the queue
+	position := float64(input.Holds-input.Available) + 1
+	// every copy serves a hold once per loan
+	fullLoans := position * float64(input.LoanDays) / float64(input.Owned)
+	days := fullLoans * earlyReturnShare
+	low := fullLoans * fastReturnShare
+	high := fullLoans
+	if input.Velocity > 0 {
+		observed := position / input.Velocity
+		days = (days + observed) / 2
+		low = min(low, observed)
+		high = max(high, observed)
+	}
+	return WaitEstimate{
+		Days: clampWaitDays(days),
+		Low:  clampWaitDays(low),
+		High: clampWaitDays(high),
+	}
+}
+
+// loanDays is the loan period of a library for a title in formats, audiobooks
+// lend longer unless the library's policy says otherwise
+func (g *generation) loanDays(libraryIdInt uint16, formats []uint8) int {
+	if policy := g.libraryMap[libraryIdInt].Policy; policy != nil && policy.LoanPeriodDays > 0 {
+		return policy.LoanPeriodDays
+	}
+	for _, formatInt := range formats {
+		if strings.HasPrefix(g.formatReverseMap[formatInt], "audiobook") {
+			return audiobookLoanDays
+		}
+	}
+	return ebookLoanDays
+}
+
+// applyWaitEstimate replaces the reported wait of counts at a library with the estimate
+func (g *generation) applyWaitEstimate(libraryIdInt uint16, counts *MediaCounts, velocity float64) {
+	estimate := estimateWait(WaitInput{
+		Owned:     counts.OwnedCount,
+		Available: counts.AvailableCount,
+		Holds:     counts.HoldsCount,
+		LoanDays:  g.loanDays(libraryIdInt, counts.Formats),
+		Velocity:  velocity,
+		Reported:  counts.EstimatedWaitDays,
+	})
+	counts.EstimatedWaitDays = estimate.Days
+	counts.WaitDaysLow = estimate.Low
+	counts.WaitDaysHigh = estimate.High
+}
+
+// decodeLibraryMediaCounts decodes the value of an la key of a library with
+// the wait estimated, without history since it's used for whole collections
+func (g *generation) decodeLibraryMediaCounts(libraryIdInt uint16, data []byte) (*MediaCounts, error) {
+	counts, err := decodeMediaCounts(data)
+	if err != nil {
+		return nil, err
+	}
+	g.applyWaitEstimate(libraryIdInt, counts, 0)
+	return counts, nil
+}
+
+func velocityKey(mediaId uint32, libraryIdInt uint16) uint64 {
+	return uint64(libraryIdInt)<<32 | uint64(mediaId)
+}
+
+// cachedQueueVelocity is queueVelocity read once per generation, unpaged
+// listings would otherwise iterate the history of every row
+func (g *generation) cachedQueueVelocity(txn *badger.Txn, mediaId uint32, libraryIdInt uint16) (float64, error) {
+	key := velocityKey(mediaId, libraryIdInt)
+	if velocity, ok := g.velocities.Load(key); ok {
+		return velocity.(float64), nil
+	}
+	velocity, err := g.queueVelocity(txn, mediaId, libraryIdInt)
+	if err != nil {
+		return 0, err
+	}
+	g.velocities.Store(key, velocity)
+	return velocity, nil
+}
+
+// queueVelocity is how many holds per day the queue of a title at a library was
+// seen shrinking by over the history, 0 when it never shrank or there's too
+// little history. the last point of a title still owned lasts until the latest snapshot
+func (g *generation) queueVelocity(txn *badger.Txn, mediaId uint32, libraryIdInt uint16) (float64, error) {
+	if g.historySnapshots < minVelocitySnapshots {
+		return 0, nil
+	}
+	prefix := binary.BigEndian.AppendUint16(getAvailabilityHistoryPrefix(mediaId), libraryIdInt)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+	var firstDay, lastDay uint16
+	var previousHolds uint16
+	served := 0
+	points := 0
+	owned := false
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		day := binary.BigEndian.Uint16(item.Key()[8:])
+		removed := false
+		var holds uint16
+		err := item.Value(func(val []byte) error {
+			if len(val) == 0 {
+				removed = true
+				return nil
+			}
+			counts, err := decodeMediaCounts(val)
+			if err != nil {
+				return err
+			}
+			holds = counts.HoldsCount
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if removed {
+			// the queue of a title that comes back starts over
+			if owned {
+				lastDay = day
+			}
+			owned = false
+			continue
+		}
+		if points == 0 {
+			firstDay = day
+		} else if owned && holds < previousHolds {
+			served += int(previousHolds - holds)
+		}
+		lastDay = day
+		previousHolds = holds
+		owned = true
+		points++
+	}
+	if owned {
+		lastDay = max(lastDay, g.latestSnapshotDay)
+	}
+	if served == 0 || lastDay <= firstDay {
+		return 0, nil
+	}
+	return float64(served) / float64(lastDay-firstDay), nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"github.com/dgraph-io/badger/v4"
+	"math"
+	"testing"
+)
+
+// waitFixtures are counts as they come in availability.csv.gz with the waits
+// the estimate should give for them
+var waitFixtures = []struct {
+	name  string
+	input WaitInput
+	want  WaitEstimate
+}{
+	{
+		name:  "more copies available than holds",
+		input: WaitInput{Owned: 3, Available: 2, Holds: 1, LoanDays: ebookLoanDays, Reported: 12},
+		want:  WaitEstimate{},
+	},
+	{
+		name:  "copy free for the next hold",
+		input: WaitInput{Owned: 2, Available: 2, Holds: 2, LoanDays: ebookLoanDays},
+		// position 1, 7 days of loans per copy
+		want: WaitEstimate{Days: 5, Low: 4, High: 7},
+	},
+	{
+		name:  "no copies falls back to the reported wait",
+		input: WaitInput{Owned: 0, Holds: 5, LoanDays: ebookLoanDays, Reported: 30},
+		want:  WaitEstimate{Days: 30, Low: 30, High: 30},
+	},
+	{
+		name:  "no copies and no reported wait",
+		input: WaitInput{Owned: 0, Holds: 5, LoanDays: ebookLoanDays, Reported: -1},
+		want:  WaitEstimate{},
+	},
+	{
+		name:  "ebook queue",
+		input: WaitInput{Owned: 2, Holds: 3, LoanDays: ebookLoanDays},
+		// position 4, 28 days of full loans
+		want: WaitEstimate{Days: 21, Low: 14, High: 28},
+	},
+	{
+		name:  "audiobook queue",
+		input: WaitInput{Owned: 2, Holds: 3, LoanDays: audiobookLoanDays},
+		want:  WaitEstimate{Days: 32, Low: 21, High: 42},
+	},
+	{
+		name:  "queue moving faster than the loans",
+		input: WaitInput{Owned: 2, Holds: 3, LoanDays: ebookLoanDays, Velocity: 0.5},
+		// observed 8 days, blended with 21
+		want: WaitEstimate{Days: 15, Low: 8, High: 28},
+	},
+	{
+		name:  "queue moving slower than the loans",
+		input: WaitInput{Owned: 2, Holds: 3, LoanDays: ebookLoanDays, Velocity: 0.1},
+		// observed 40 days, blended with 21
+		want: WaitEstimate{Days: 31, Low: 14, High: 40},
+	},
+	{
+		name:  "reported wait is ignored when the counts can be modelled",
+		input: WaitInput{Owned: 1, Holds: 0, LoanDays: ebookLoanDays, Reported: 90},
+		want:  WaitEstimate{Days: 11, Low: 7, High: 14},
+	},
+	{
+		name:  "long queue saturates",
+		input: WaitInput{Owned: 1, Holds: 65535, LoanDays: 365},
+		want:  WaitEstimate{Days: 32767, Low: 32767, High: 32767},
+	},
+}
+
+func TestEstimateWait(t *testing.T) {
+	for _, fixture := range waitFixtures {
+		t.Run(fixture.name, func(t *testing.T) {
+			got := estimateWait(fixture.input)
+			if got != fixture.want {
+				t.Errorf("estimateWait(%+v) = %+v, want %+v", fixture.input, got, fixture.want)
+			}
+			if got.Low > got.Days || got.Days > got.High {
+				t.Errorf("estimateWait(%+v) = %+v, range out of order", fixture.input, got)
+			}
+		})
+	}
+}
+
+func TestLoanDays(t *testing.T) {
+	g := newGeneration(0)
+	g.formatReverseMap = map[uint8]string{1: "ebook-kindle", 2: "audiobook-overdrive"}
+	g.libraryMap = map[uint16]Library{
+		1: {Id: "nopolicy"},
+		2: {Id: "policy", Policy: &LibraryPolicy{LoanPeriodDays: 7}},
+		3: {Id: "nolimits", Policy: &LibraryPolicy{MaxHolds: 5}},
+	}
+	tests := []struct {
+		name         string
+		libraryIdInt uint16
+		formats      []uint8
+		want         int
+	}{
+		{"ebook", 1, []uint8{1}, ebookLoanDays},
+		{"audiobook", 1, []uint8{2}, audiobookLoanDays},
+		{"ebook and audiobook", 1, []uint8{1, 2}, audiobookLoanDays},
+		{"no formats", 1, nil, ebookLoanDays},
+		{"policy overrides ebook", 2, []uint8{1}, 7},
+		{"policy overrides audiobook", 2, []uint8{2}, 7},
+		{"policy without a loan period", 3, []uint8{2}, audiobookLoanDays},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := g.loanDays(test.libraryIdInt, test.formats); got != test.want {
+				t.Errorf("loanDays(%d, %v) = %d, want %d", test.libraryIdInt, test.formats, got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyWaitEstimate(t *testing.T) {
+	g := newGeneration(0)
+	g.formatReverseMap = map[uint8]string{1: "audiobook-overdrive"}
+	g.libraryMap = map[uint16]Library{
+		1: {Id: "nopolicy"},
+		2: {Id: "policy", Policy: &LibraryPolicy{LoanPeriodDays: 28}},
+	}
+	tests := []struct {
+		name         string
+		libraryIdInt uint16
+		want         WaitEstimate
+	}{
+		// position 1 with one copy, a full loan is 21 days
+		{"audiobook loan period", 1, WaitEstimate{Days: 16, Low: 11, High: 21}},
+		{"policy loan period", 2, WaitEstimate{Days: 21, Low: 14, High: 28}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			counts := &MediaCounts{OwnedCount: 1, EstimatedWaitDays: 3, Formats: []uint8{1}}
+			g.applyWaitEstimate(test.libraryIdInt, counts, 0)
+			got := WaitEstimate{Days: counts.EstimatedWaitDays, Low: counts.WaitDaysLow, High: counts.WaitDaysHigh}
+			if got != test.want {
+				t.Errorf("applyWaitEstimate = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// writeHistory writes the ah points of a title at library 1, a point without holds is a removal
+func writeHistory(t *testing.T, mediaId uint32, points map[uint16][]uint16) {
+	t.Helper()
+	err := db.Update(func(txn *badger.Txn) error {
+		for day, holds := range points {
+			value := []byte{}
+			if len(holds) > 0 {
+				value = encodeMediaCounts(&MediaCounts{OwnedCount: 1, HoldsCount: holds[0]})
+			}
+			if err := txn.Set(getAvailabilityHistoryKey(mediaId, 1, day), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueVelocity(t *testing.T) {
+	openTestDB(t)
+	g := newGeneration(0)
+	g.historySnapshots = 3
+	g.latestSnapshotDay = 30
+	tests := []struct {
+		name   string
+		points map[uint16][]uint16
+		want   float64
+	}{
+		{"no history", nil, 0},
+		{"single point", map[uint16][]uint16{10: {5}}, 0},
+		// the last point lasts until the latest snapshot
+		{"queue shrinking", map[uint16][]uint16{10: {10}, 20: {6}}, 0.2},
+		{"queue growing", map[uint16][]uint16{10: {2}, 20: {6}}, 0},
+		{"removed", map[uint16][]uint16{10: {10}, 15: {5}, 20: {}}, 0.5},
+		// the drop across the removal isn't served holds
+		{"removed and added back", map[uint16][]uint16{10: {10}, 12: {}, 14: {2}, 20: {1}}, 0.05},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mediaId := uint32(i + 1)
+			writeHistory(t, mediaId, test.points)
+			err := db.View(func(txn *badger.Txn) error {
+				got, err := g.queueVelocity(txn, mediaId, 1)
+				if err != nil {
+					return err
+				}
+				if math.Abs(got-test.want) > 1e-9 {
+					t.Errorf("queueVelocity = %v, want %v", got, test.want)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	t.Run("too few snapshots", func(t *testing.T) {
+		g := newGeneration(0)
+		g.historySnapshots = 1
+		g.latestSnapshotDay = 30
+		err := db.View(func(txn *badger.Txn) error {
+			if got, err := g.queueVelocity(txn, 3, 1); err != nil || got != 0 {
+				t.Errorf("queueVelocity = %v, %v, want 0", got, err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestGetLibraryMediaCountsVelocity(t *testing.T) {
+	openTestDB(t)
+	g := newGeneration(0)
+	g.historySnapshots = 3
+	g.latestSnapshotDay = 30
+	g.libraryMap = map[uint16]Library{1: {Id: "nopolicy"}}
+	err := db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(g.getLibraryAvailabilityKey(1, 1), encodeMediaCounts(&MediaCounts{OwnedCount: 1, HoldsCount: 3})); err != nil {
+			return err
+		}
+		return txn.Set(g.getLibraryAvailabilityKey(1, 2), encodeMediaCounts(&MediaCounts{OwnedCount: 1, AvailableCount: 1}))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 holds served over 20 days, the observed wait of position 4 is 40 days
+	writeHistory(t, 1, map[uint16][]uint16{10: {5}, 20: {3}})
+	writeHistory(t, 2, map[uint16][]uint16{10: {5}, 20: {0}})
+	read := func(mediaId uint32) WaitEstimate {
+		var estimate WaitEstimate
+		err := db.View(func(txn *badger.Txn) error {
+			counts, err := g.getLibraryMediaCounts(txn, 1, mediaId)
+			if err != nil {
+				return err
+			}
+			estimate = WaitEstimate{Days: counts.EstimatedWaitDays, Low: counts.WaitDaysLow, High: counts.WaitDaysHigh}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return estimate
+	}
+	// 42 days of loans blended with the observed 40
+	want := WaitEstimate{Days: 41, Low: 28, High: 56}
+	if got := read(1); got != want {
+		t.Errorf("estimate with velocity = %+v, want %+v", got, want)
+	}
+	if got := read(2); got != (WaitEstimate{}) {
+		t.Errorf("estimate without a queue = %+v, want none", got)
+	}
+	if _, cached := g.velocities.Load(velocityKey(2, 1)); cached {
+		t.Error("velocity was read for a title without a queue")
+	}
+	// the velocity is cached for the generation
+	if err := deleteKeysWithPrefix(getAvailabilityHistoryPrefix(1)); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(1); got != want {
+		t.Errorf("cached estimate = %+v, want %+v", got, want)
+	}
+}
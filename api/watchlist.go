@@ -0,0 +1,679 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// watchlists are durable, they're kept across generations:
+//
+//	wl<watchlistId> -> watchlist json
+//	wt<watchlistId><mediaId uint32><libraryId uint16> -> available uint16, estimatedWaitDays int16 last evaluated
+//	wn<watchlistId><unix nanos uint64><index uint16> -> alert json
+//	we<watchlistId> -> email confirmation token, until the email is confirmed
+//
+// the random watchlist id is the only credential, whoever has it can read and
+// change the watchlist. alerts are only emailed once the link mailed to the
+// address has been followed, so a watchlist can't send mail to someone else
+
+const (
+	alertKindAvailable  = "available"
+	alertKindNewLibrary = "newLibrary"
+	alertKindWait       = "wait"
+	// watchlistIdLength is the length of the hex watchlist id
+	watchlistIdLength = 32
+	// defaultAlertLimit is how many alerts are returned without a limit
+	defaultAlertLimit = 50
+)
+
+type Watchlist struct {
+	Id       string   `json:"id"`
+	MediaIds []uint32 `json:"mediaIds"`
+	// LibraryIds are the libraries watched, every visible library when empty
+	LibraryIds []string `json:"libraryIds"`
+	// WaitThresholdDays raises an alert when the wait drops to it, 0 disables wait alerts
+	WaitThresholdDays int       `json:"waitThresholdDays,omitempty"`
+	Email             string    `json:"email,omitempty"`
+	EmailConfirmed    bool      `json:"emailConfirmed,omitempty"`
+	WebhookUrl        string    `json:"webhookUrl,omitempty"`
+	Created           time.Time `json:"created"`
+}
+
+type WatchlistRequest struct {
+	MediaIds          []uint32 `json:"mediaIds"`
+	LibraryIds        []string `json:"libraryIds"`
+	WaitThresholdDays int      `json:"waitThresholdDays"`
+	Email             string   `json:"email"`
+	WebhookUrl        string   `json:"webhookUrl"`
+}
+
+type WatchlistAlert struct {
+	MediaId           uint32    `json:"mediaId"`
+	Title             string    `json:"title"`
+	LibraryId         string    `json:"libraryId"`
+	Kind              string    `json:"kind"`
+	AvailableCount    uint16    `json:"availableCount"`
+	EstimatedWaitDays int16     `json:"estimatedWaitDays"`
+	Snapshot          string    `json:"snapshot"`
+	Created           time.Time `json:"created"`
+}
+
+type WatchlistAlertsResponse struct {
+	WatchlistId string           `json:"watchlistId"`
+	Alerts      []WatchlistAlert `json:"alerts"`
+}
+
+// watchedState is what a watched title looked like at a library when it was last evaluated
+type watchedState struct {
+	available uint16
+	waitDays  int16
+}
+
+// watchlistMutex keeps evaluations from interleaving with each other and with watchlist changes
+var watchlistMutex sync.Mutex
+
+func getWatchlistKey(watchlistId string) []byte {
+	return append([]byte("wl"), watchlistId...)
+}
+
+func getWatchedStatePrefix(watchlistId string) []byte {
+	return append([]byte("wt"), watchlistId...)
+}
+
+func getWatchedStateKey(watchlistId string, mediaId uint32, libraryIdInt uint16) []byte {
+	key := binary.BigEndian.AppendUint32(getWatchedStatePrefix(watchlistId), mediaId)
+	return binary.BigEndian.AppendUint16(key, libraryIdInt)
+}
+
+func getWatchlistAlertPrefix(watchlistId string) []byte {
+	return append([]byte("wn"), watchlistId...)
+}
+
+func getWatchlistAlertKey(watchlistId string, created time.Time, index int) []byte {
+	key := binary.BigEndian.AppendUint64(getWatchlistAlertPrefix(watchlistId), uint64(created.UnixNano()))
+	return binary.BigEndian.AppendUint16(key, uint16(index))
+}
+
+func getEmailConfirmationKey(watchlistId string) []byte {
+	return append([]byte("we"), watchlistId...)
+}
+
+func newWatchlistId() (string, error) {
+	buf := make([]byte, watchlistIdLength/2)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func validWatchlistId(watchlistId string) bool {
+	if len(watchlistId) != watchlistIdLength {
+		return false
+	}
+	_, err := hex.DecodeString(watchlistId)
+	return err == nil
+}
+
+// validate checks a watchlist request against g and keeps only the address of
+// its email, the error is a message for the user
+func (request *WatchlistRequest) validate(g *generation) error {
+	if len(request.MediaIds) == 0 {
+		return errors.New("mediaIds is required")
+	}
+	if len(request.MediaIds) > cfg.MaxBatchSize {
+		return fmt.Errorf("at most %d mediaIds can be watched", cfg.MaxBatchSize)
+	}
+	for _, libraryId := range request.LibraryIds {
+		if _, _, exists := g.lookupLibrary(libraryId); !exists {
+			return fmt.Errorf("invalid library id %s", libraryId)
+		}
+	}
+	if request.WaitThresholdDays < 0 {
+		return errors.New("invalid waitThresholdDays")
+	}
+	if request.Email != "" {
+		// only the address is kept, a display name would end up in the smtp envelope
+		addr, err := mail.ParseAddress(request.Email)
+		if err != nil {
+			return fmt.Errorf("invalid email %q", request.Email)
+		}
+		request.Email = addr.Address
+	}
+	if request.WebhookUrl != "" {
+		webhookUrl, err := url.Parse(request.WebhookUrl)
+		if err != nil || (webhookUrl.Scheme != "http" && webhookUrl.Scheme != "https") || webhookUrl.Host == "" {
+			return fmt.Errorf("invalid webhookUrl %q", request.WebhookUrl)
+		}
+	}
+	return nil
+}
+
+func readWatchlist(txn *badger.Txn, watchlistId string) (*Watchlist, error) {
+	item, err := txn.Get(getWatchlistKey(watchlistId))
+	if err != nil {
+		return nil, err
+	}
+	watchlist := &Watchlist{}
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, watchlist)
+	})
+	return watchlist, err
+}
+
+func writeWatchlist(txn *badger.Txn, watchlist *Watchlist) error {
+	buf, err := json.Marshal(watchlist)
+	if err != nil {
+		return err
+	}
+	return txn.Set(getWatchlistKey(watchlist.Id), buf)
+}
+
+func readWatchlists() ([]*Watchlist, error) {
+	var watchlists []*Watchlist
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("wl")
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			watchlist := &Watchlist{}
+			err := iter.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, watchlist)
+			})
+			if err != nil {
+				return err
+			}
+			watchlists = append(watchlists, watchlist)
+		}
+		return nil
+	})
+	return watchlists, err
+}
+
+// watchedLibraries are the visible libraries a watchlist watches, libraries
+// that were hidden or removed since it was saved are skipped
+func (g *generation) watchedLibraries(watchlist *Watchlist) map[uint16]Library {
+	if len(watchlist.LibraryIds) == 0 {
+		return g.visibility().libraries
+	}
+	libraries := map[uint16]Library{}
+	for _, libraryId := range watchlist.LibraryIds {
+		if libraryIdInt, library, exists := g.lookupLibrary(libraryId); exists {
+			libraries[libraryIdInt] = library
+		}
+	}
+	return libraries
+}
+
+// readWatchedStates returns the last evaluated state of a watched title by library
+func readWatchedStates(txn *badger.Txn, watchlistId string, mediaId uint32) (map[uint16]watchedState, error) {
+	states := map[uint16]watchedState{}
+	prefix := binary.BigEndian.AppendUint32(getWatchedStatePrefix(watchlistId), mediaId)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		libraryIdInt := binary.BigEndian.Uint16(item.Key()[len(prefix):])
+		err := item.Value(func(val []byte) error {
+			states[libraryIdInt] = watchedState{
+				available: binary.BigEndian.Uint16(val[0:2]),
+				waitDays:  int16(binary.BigEndian.Uint16(val[2:4])),
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return states, nil
+}
+
+// evaluateWatchlist compares the watched titles in g with their last evaluated
+// state, stores the new state and returns the alerts. a baseline only stores
+// the state, so a new watchlist doesn't alert on what's already true. on an
+// error the alerts of the titles evaluated so far are returned with it
+func (g *generation) evaluateWatchlist(watchlist *Watchlist, baseline bool) ([]WatchlistAlert, error) {
+	snapshotDate := ""
+	if day, err := snapshotDay(); err == nil {
+		snapshotDate = dayToDate(day)
+	}
+	now := time.Now().UTC()
+	libraries := g.watchedLibraries(watchlist)
+	var alerts []WatchlistAlert
+	for _, mediaId := range watchlist.MediaIds {
+		// a transaction per title keeps a watchlist of every library within badger's transaction size
+		var titleAlerts []WatchlistAlert
+		err := db.Update(func(txn *badger.Txn) error {
+			title := ""
+			if media, err := g.getMediaTxn(txn, mediaId); err == nil {
+				title = media.Title
+			}
+			previousStates, err := readWatchedStates(txn, watchlist.Id, mediaId)
+			if err != nil {
+				return err
+			}
+			// states of libraries that dropped the title (or are no longer watched) are forgotten
+			for libraryIdInt := range previousStates {
+				_, watched := libraries[libraryIdInt]
+				if !watched || !g.libraryBitmap(libraryIdInt).Contains(mediaId) {
+					if err := txn.Delete(getWatchedStateKey(watchlist.Id, mediaId, libraryIdInt)); err != nil {
+						return err
+					}
+				}
+			}
+			for libraryIdInt, library := range libraries {
+				if !g.libraryBitmap(libraryIdInt).Contains(mediaId) {
+					continue
+				}
+				previous, seen := previousStates[libraryIdInt]
+				counts, err := g.getLibraryMediaCounts(txn, libraryIdInt, mediaId)
+				if err != nil {
+					return err
+				}
+				value := binary.BigEndian.AppendUint16(nil, counts.AvailableCount)
+				value = binary.BigEndian.AppendUint16(value, uint16(counts.EstimatedWaitDays))
+				if err := txn.Set(getWatchedStateKey(watchlist.Id, mediaId, libraryIdInt), value); err != nil {
+					return err
+				}
+				if baseline {
+					continue
+				}
+				kind := ""
+				switch {
+				case !seen:
+					kind = alertKindNewLibrary
+				case previous.available == 0 && counts.AvailableCount > 0:
+					kind = alertKindAvailable
+				case watchlist.WaitThresholdDays > 0 && counts.AvailableCount == 0 &&
+					int(previous.waitDays) > watchlist.WaitThresholdDays &&
+					int(counts.EstimatedWaitDays) <= watchlist.WaitThresholdDays:
+					kind = alertKindWait
+				}
+				if kind == "" {
+					continue
+				}
+				alert := WatchlistAlert{
+					MediaId:           mediaId,
+					Title:             title,
+					LibraryId:         library.Id,
+					Kind:              kind,
+					AvailableCount:    counts.AvailableCount,
+					EstimatedWaitDays: counts.EstimatedWaitDays,
+					Snapshot:          snapshotDate,
+					Created:           now,
+				}
+				buf, err := json.Marshal(alert)
+				if err != nil {
+					return err
+				}
+				if err := txn.Set(getWatchlistAlertKey(watchlist.Id, now, len(alerts)+len(titleAlerts)), buf); err != nil {
+					return err
+				}
+				titleAlerts = append(titleAlerts, alert)
+			}
+			return nil
+		})
+		if err != nil {
+			return alerts, err
+		}
+		alerts = append(alerts, titleAlerts...)
+	}
+	return alerts, nil
+}
+
+// watchlistNotification is the alerts of one watchlist waiting for its notifiers
+type watchlistNotification struct {
+	watchlist *Watchlist
+	alerts    []WatchlistAlert
+}
+
+// evaluateWatchlists raises the alerts of every watchlist against the current
+// generation after a load and hands them to the watchlist's notifiers once
+// watchlistMutex is released, so slow notifiers don't block watchlist edits
+func evaluateWatchlists() {
+	g := acquireGeneration()
+	defer g.release()
+	start := time.Now()
+	notifications, count, err := g.raiseWatchlistAlerts()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read watchlists")
+		return
+	}
+	total := 0
+	for _, notification := range notifications {
+		total += len(notification.alerts)
+		notifyWatchlist(notification.watchlist, notification.alerts)
+	}
+	log.Info().Uint32("generation", g.id).Int("watchlists", count).Int("alerts", total).
+		Dur("duration", time.Since(start)).
+		Msg("evaluated watchlists")
+}
+
+// raiseWatchlistAlerts evaluates and stores the alerts of every watchlist, it
+// returns the watchlists that raised alerts and how many watchlists there are
+func (g *generation) raiseWatchlistAlerts() ([]watchlistNotification, int, error) {
+	watchlistMutex.Lock()
+	defer watchlistMutex.Unlock()
+	watchlists, err := readWatchlists()
+	if err != nil {
+		return nil, 0, err
+	}
+	var notifications []watchlistNotification
+	for _, watchlist := range watchlists {
+		// the alerts of titles evaluated before an error are stored, so they're still sent
+		alerts, err := g.evaluateWatchlist(watchlist, false)
+		if err != nil {
+			log.Error().Err(err).Str("watchlist", watchlist.Id).Msg("failed to evaluate watchlist")
+		}
+		if len(alerts) > 0 {
+			notifications = append(notifications, watchlistNotification{watchlist: watchlist, alerts: alerts})
+		}
+	}
+	return notifications, len(watchlists), nil
+}
+
+// notifyWatchlist delivers alerts through every notifier of the watchlist, a
+// failed delivery is logged, the alerts stay readable from /api/watchlist/alerts
+func notifyWatchlist(watchlist *Watchlist, alerts []WatchlistAlert) {
+	for _, notifier := range notifiersFor(watchlist) {
+		ctx, cancel := context.WithTimeout(context.Background(), notifierTimeout)
+		err := notifier.Notify(ctx, watchlist, alerts)
+		cancel()
+		if err != nil {
+			log.Error().Err(err).Str("watchlist", watchlist.Id).Str("notifier", notifier.Name()).Msg("failed to deliver watchlist alerts")
+			continue
+		}
+		log.Debug().Str("watchlist", watchlist.Id).Str("notifier", notifier.Name()).Int("alerts", len(alerts)).Msg("delivered watchlist alerts")
+	}
+}
+
+func watchlistIdParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	watchlistId := r.URL.Query().Get("id")
+	if !validWatchlistId(watchlistId) {
+		http.Error(w, "invalid watchlist id", http.StatusBadRequest)
+		return "", false
+	}
+	return watchlistId, true
+}
+
+func writeWatchlistResponse(w http.ResponseWriter, status int, watchlist *Watchlist) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(watchlist); err != nil {
+		log.Error().Err(err).Msg("failed to encode watchlist")
+	}
+}
+
+// saveWatchlistHandler creates a watchlist on POST and replaces one on PUT ?id=
+func saveWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	g := requestGeneration(r)
+	var request WatchlistRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "invalid watchlist: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	watchlist := &Watchlist{
+		MediaIds:          request.MediaIds,
+		LibraryIds:        request.LibraryIds,
+		WaitThresholdDays: request.WaitThresholdDays,
+		Email:             request.Email,
+		WebhookUrl:        request.WebhookUrl,
+		Created:           time.Now().UTC(),
+	}
+	status := http.StatusCreated
+	if r.Method == http.MethodPut {
+		watchlistId, ok := watchlistIdParam(w, r)
+		if !ok {
+			return
+		}
+		watchlist.Id = watchlistId
+		status = http.StatusOK
+	} else {
+		var err error
+		watchlist.Id, err = newWatchlistId()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to generate watchlist id")
+			http.Error(w, "failed to save watchlist", http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Info().Msgf("%s /api/watchlist titles: %d", r.Method, len(watchlist.MediaIds))
+	watchlistMutex.Lock()
+	defer watchlistMutex.Unlock()
+	confirmationToken := ""
+	err := db.Update(func(txn *badger.Txn) error {
+		if r.Method == http.MethodPut {
+			existing, err := readWatchlist(txn, watchlist.Id)
+			if err != nil {
+				return err
+			}
+			watchlist.Created = existing.Created
+			watchlist.EmailConfirmed = existing.EmailConfirmed && existing.Email == watchlist.Email
+		}
+		if watchlist.Email == "" || watchlist.EmailConfirmed {
+			if err := txn.Delete(getEmailConfirmationKey(watchlist.Id)); err != nil {
+				return err
+			}
+		} else {
+			// a changed email is confirmed again, the token has the shape of a watchlist id
+			var err error
+			confirmationToken, err = newWatchlistId()
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(getEmailConfirmationKey(watchlist.Id), []byte(confirmationToken)); err != nil {
+				return err
+			}
+		}
+		return writeWatchlist(txn, watchlist)
+	})
+	if err == nil {
+		_, err = g.evaluateWatchlist(watchlist, true)
+	}
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		http.Error(w, "watchlist not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to save watchlist")
+		http.Error(w, "failed to save watchlist", http.StatusInternalServerError)
+		return
+	}
+	if confirmationToken != "" {
+		confirmUrl := fmt.Sprintf("%s/api/watchlist/confirm?id=%s&token=%s", feedBaseUrl(r), watchlist.Id, confirmationToken)
+		go sendEmailConfirmation(watchlist, confirmUrl)
+	}
+	writeWatchlistResponse(w, status, watchlist)
+}
+
+// confirmWatchlistEmailHandler is the link mailed to a watchlist's email,
+// following it lets alerts be emailed
+func confirmWatchlistEmailHandler(w http.ResponseWriter, r *http.Request) {
+	watchlistId, ok := watchlistIdParam(w, r)
+	if !ok {
+		return
+	}
+	token := r.URL.Query().Get("token")
+	watchlistMutex.Lock()
+	defer watchlistMutex.Unlock()
+	var watchlist *Watchlist
+	err := db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(getEmailConfirmationKey(watchlistId))
+		if err != nil {
+			return err
+		}
+		expected, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(expected, []byte(token)) != 1 {
+			return badger.ErrKeyNotFound
+		}
+		watchlist, err = readWatchlist(txn, watchlistId)
+		if err != nil {
+			return err
+		}
+		watchlist.EmailConfirmed = true
+		if err := writeWatchlist(txn, watchlist); err != nil {
+			return err
+		}
+		return txn.Delete(getEmailConfirmationKey(watchlistId))
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		http.Error(w, "invalid or expired confirmation link", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to confirm watchlist email")
+		http.Error(w, "failed to confirm watchlist email", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("watchlist", watchlistId).Msg("confirmed watchlist email")
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%s is confirmed, watchlist alerts will be emailed to it\n", watchlist.Email)
+}
+
+func getWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	watchlistId, ok := watchlistIdParam(w, r)
+	if !ok {
+		return
+	}
+	var watchlist *Watchlist
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		watchlist, err = readWatchlist(txn, watchlistId)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		http.Error(w, "watchlist not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read watchlist")
+		http.Error(w, "failed to read watchlist", http.StatusInternalServerError)
+		return
+	}
+	writeWatchlistResponse(w, http.StatusOK, watchlist)
+}
+
+func deleteWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	watchlistId, ok := watchlistIdParam(w, r)
+	if !ok {
+		return
+	}
+	watchlistMutex.Lock()
+	defer watchlistMutex.Unlock()
+	err := db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(getWatchlistKey(watchlistId))
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		http.Error(w, "watchlist not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = deleteKeysWithPrefix(getWatchlistKey(watchlistId), getWatchedStatePrefix(watchlistId),
+			getWatchlistAlertPrefix(watchlistId), getEmailConfirmationKey(watchlistId))
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to delete watchlist")
+		http.Error(w, "failed to delete watchlist", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("watchlist", watchlistId).Msg("deleted watchlist")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// watchlistAlertsHandler returns the alerts of a watchlist newest first, since
+// (RFC 3339) and limit narrow them down
+func watchlistAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	watchlistId, ok := watchlistIdParam(w, r)
+	if !ok {
+		return
+	}
+	var since time.Time
+	if sinceParam := r.URL.Query().Get("since"); sinceParam != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, sinceParam)
+		if err != nil {
+			http.Error(w, "invalid since, expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultAlertLimit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	log.Info().Msgf("/api/watchlist/alerts since: %v limit: %d", since, limit)
+	alerts := []WatchlistAlert{}
+	err := db.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get(getWatchlistKey(watchlistId)); err != nil {
+			return err
+		}
+		prefix := getWatchlistAlertPrefix(watchlistId)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.Reverse = true
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		// reverse iteration starts after the last key with the prefix
+		for iter.Seek(append(append([]byte{}, prefix...), 0xff)); iter.Valid() && len(alerts) < limit; iter.Next() {
+			var alert WatchlistAlert
+			err := iter.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &alert)
+			})
+			if err != nil {
+				return err
+			}
+			if alert.Created.Before(since) {
+				break
+			}
+			alerts = append(alerts, alert)
+		}
+		return nil
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		http.Error(w, "watchlist not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read watchlist alerts")
+		http.Error(w, "failed to read watchlist alerts", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(WatchlistAlertsResponse{
+		WatchlistId: watchlistId,
+		Alerts:      alerts,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode watchlist alerts")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dgraph-io/badger/v4"
+	"reflect"
+	"testing"
+)
+
+// newWatchlistTestGeneration is a generation where library 1 (nypl) owns the
+// titles of counts, a nil entry isn't owned
+func newWatchlistTestGeneration(t *testing.T, id uint32, counts map[uint32]*MediaCounts) *generation {
+	t.Helper()
+	g := newGeneration(id)
+	g.libraryIdMap["nypl"] = 1
+	g.libraryMap[1] = Library{Id: "nypl"}
+	owned := roaring.New()
+	err := db.Update(func(txn *badger.Txn) error {
+		for mediaId, mediaCounts := range counts {
+			if mediaCounts == nil {
+				continue
+			}
+			owned.Add(mediaId)
+			if err := txn.Set(g.getLibraryAvailabilityKey(1, uint64(mediaId)), encodeMediaCounts(mediaCounts)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.libraryBitmaps[1] = owned
+	return g
+}
+
+func TestEvaluateWatchlist(t *testing.T) {
+	openTestDB(t)
+	useDefaultLibraryRules(t)
+	tests := []struct {
+		name          string
+		waitThreshold int
+		// before and after are the counts at nypl in the two loads, nil when it doesn't own the title
+		before, after *MediaCounts
+		want          []string
+	}{
+		{
+			name:   "copy became available",
+			before: &MediaCounts{OwnedCount: 1, HoldsCount: 2},
+			after:  &MediaCounts{OwnedCount: 1, AvailableCount: 1},
+			want:   []string{alertKindAvailable},
+		},
+		{
+			name:   "still available",
+			before: &MediaCounts{OwnedCount: 1, AvailableCount: 1},
+			after:  &MediaCounts{OwnedCount: 2, AvailableCount: 2},
+		},
+		{
+			name:   "still on hold",
+			before: &MediaCounts{OwnedCount: 1, HoldsCount: 2},
+			after:  &MediaCounts{OwnedCount: 1, HoldsCount: 1},
+		},
+		{
+			name:  "library started owning it",
+			after: &MediaCounts{OwnedCount: 1, HoldsCount: 5},
+			want:  []string{alertKindNewLibrary},
+		},
+		{
+			name:   "library stopped owning it",
+			before: &MediaCounts{OwnedCount: 1, HoldsCount: 5},
+		},
+		{
+			// 42 days for position 4 of one copy, 11 days for position 2 of two copies
+			name:          "wait dropped to the threshold",
+			waitThreshold: 14,
+			before:        &MediaCounts{OwnedCount: 1, HoldsCount: 3},
+			after:         &MediaCounts{OwnedCount: 2, HoldsCount: 1},
+			want:          []string{alertKindWait},
+		},
+		{
+			name:          "wait still above the threshold",
+			waitThreshold: 7,
+			before:        &MediaCounts{OwnedCount: 1, HoldsCount: 3},
+			after:         &MediaCounts{OwnedCount: 2, HoldsCount: 1},
+		},
+		{
+			name:   "wait alerts disabled",
+			before: &MediaCounts{OwnedCount: 1, HoldsCount: 3},
+			after:  &MediaCounts{OwnedCount: 2, HoldsCount: 1},
+		},
+		{
+			name:          "available wins over the wait",
+			waitThreshold: 14,
+			before:        &MediaCounts{OwnedCount: 1, HoldsCount: 3},
+			after:         &MediaCounts{OwnedCount: 2, AvailableCount: 1},
+			want:          []string{alertKindAvailable},
+		},
+	}
+	before := map[uint32]*MediaCounts{}
+	after := map[uint32]*MediaCounts{}
+	for i, test := range tests {
+		before[uint32(i+1)] = test.before
+		after[uint32(i+1)] = test.after
+	}
+	first := newWatchlistTestGeneration(t, 1, before)
+	second := newWatchlistTestGeneration(t, 2, after)
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			watchlist := &Watchlist{
+				Id:                fmt.Sprintf("%032x", i+1),
+				MediaIds:          []uint32{uint32(i + 1)},
+				WaitThresholdDays: test.waitThreshold,
+			}
+			alerts, err := first.evaluateWatchlist(watchlist, true)
+			if err != nil {
+				t.Fatalf("baseline: %v", err)
+			}
+			if len(alerts) > 0 {
+				t.Fatalf("baseline raised %+v", alerts)
+			}
+			alerts, err = second.evaluateWatchlist(watchlist, false)
+			if err != nil {
+				t.Fatalf("evaluateWatchlist: %v", err)
+			}
+			var kinds []string
+			for _, alert := range alerts {
+				kinds = append(kinds, alert.Kind)
+				if alert.MediaId != uint32(i+1) || alert.LibraryId != "nypl" {
+					t.Errorf("alert for %d at %s, want %d at nypl", alert.MediaId, alert.LibraryId, i+1)
+				}
+			}
+			if !reflect.DeepEqual(kinds, test.want) {
+				t.Errorf("alerts = %v, want %v", kinds, test.want)
+			}
+			// a second evaluation of the same load has nothing new
+			alerts, err = second.evaluateWatchlist(watchlist, false)
+			if err != nil {
+				t.Fatalf("evaluateWatchlist: %v", err)
+			}
+			if len(alerts) > 0 {
+				t.Errorf("reevaluating raised %+v", alerts)
+			}
+		})
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// webhook subscriptions are told about the availability change set of every
+// load. they're durable and managed through /api/admin/webhooks:
+//
+//	hk<subscriptionId> -> subscription json
+//	hd<subscriptionId><unix nanos uint64> -> delivery json, the delivery log, pruned with the history
+//
+// payloads are signed with the subscription's secret, the X-Deeplibby-Signature
+// header is sha256=<hex hmac-sha256 of the body>
+
+const (
+	webhookEventAdded   = "added"
+	webhookEventRemoved = "removed"
+	webhookEventChanged = "changed"
+	// webhookBatchSize is how many titles one payload holds at most
+	webhookBatchSize = 500
+	// webhookMaxAttempts and webhookBackoff bound the retries of a delivery,
+	// the wait doubles after every failed attempt
+	webhookMaxAttempts = 5
+	webhookBackoff     = time.Second
+	// minWebhookSecretLength keeps secrets long enough to sign with
+	minWebhookSecretLength = 16
+	// defaultDeliveryLimit is how many deliveries are listed without a limit
+	defaultDeliveryLimit = 50
+)
+
+var webhookEvents = []string{webhookEventAdded, webhookEventRemoved, webhookEventChanged}
+
+type WebhookSubscription struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+	// LibraryIds are the libraries reported, every visible library when empty
+	LibraryIds []string `json:"libraryIds"`
+	// Events are the event types reported, every event when empty
+	Events []string `json:"events"`
+	// Secret is only returned when the subscription is created
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type WebhookSubscriptionRequest struct {
+	Url        string   `json:"url"`
+	LibraryIds []string `json:"libraryIds"`
+	Events     []string `json:"events"`
+	// Secret is generated when empty
+	Secret string `json:"secret"`
+}
+
+// WebhookTitle is a title in a payload, counts are left out for removed titles
+type WebhookTitle struct {
+	MediaId uint32 `json:"mediaId"`
+	Title   string `json:"title"`
+	*MediaCountResults
+}
+
+type WebhookPayload struct {
+	DeliveryId string         `json:"deliveryId"`
+	Event      string         `json:"event"`
+	LibraryId  string         `json:"libraryId"`
+	Snapshot   string         `json:"snapshot"`
+	Sent       time.Time      `json:"sent"`
+	Titles     []WebhookTitle `json:"titles"`
+}
+
+type WebhookDelivery struct {
+	DeliveryId string    `json:"deliveryId"`
+	Event      string    `json:"event"`
+	LibraryId  string    `json:"libraryId"`
+	Snapshot   string    `json:"snapshot"`
+	Titles     int       `json:"titles"`
+	Attempts   int       `json:"attempts"`
+	Success    bool      `json:"success"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Created    time.Time `json:"created"`
+}
+
+type WebhookDeliveriesResponse struct {
+	SubscriptionId string            `json:"subscriptionId"`
+	Deliveries     []WebhookDelivery `json:"deliveries"`
+}
+
+func getWebhookKey(subscriptionId string) []byte {
+	return append([]byte("hk"), subscriptionId...)
+}
+
+func getWebhookDeliveryPrefix(subscriptionId string) []byte {
+	return append([]byte("hd"), subscriptionId...)
+}
+
+func getWebhookDeliveryKey(subscriptionId string, created time.Time) []byte {
+	return binary.BigEndian.AppendUint64(getWebhookDeliveryPrefix(subscriptionId), uint64(created.UnixNano()))
+}
+
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (request *WebhookSubscriptionRequest) validate(g *generation) error {
+	webhookUrl, err := url.Parse(request.Url)
+	if err != nil || (webhookUrl.Scheme != "http" && webhookUrl.Scheme != "https") || webhookUrl.Host == "" {
+		return fmt.Errorf("invalid url %q", request.Url)
+	}
+	for _, libraryId := range request.LibraryIds {
+		if _, _, exists := g.lookupLibrary(libraryId); !exists {
+			return fmt.Errorf("invalid library id %s", libraryId)
+		}
+	}
+	for _, event := range request.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return fmt.Errorf("invalid event %q, expected one of %v", event, webhookEvents)
+		}
+	}
+	if request.Secret != "" && len(request.Secret) < minWebhookSecretLength {
+		return fmt.Errorf("secret needs at least %d characters", minWebhookSecretLength)
+	}
+	return nil
+}
+
+func (s *WebhookSubscription) wants(event string, libraryId string) bool {
+	if len(s.Events) > 0 && !slices.Contains(s.Events, event) {
+		return false
+	}
+	return len(s.LibraryIds) == 0 || slices.Contains(s.LibraryIds, libraryId)
+}
+
+func readWebhookSubscriptions() ([]*WebhookSubscription, error) {
+	var subscriptions []*WebhookSubscription
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("hk")
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			subscription := &WebhookSubscription{}
+			err := iter.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, subscription)
+			})
+			if err != nil {
+				return err
+			}
+			subscriptions = append(subscriptions, subscription)
+		}
+		return nil
+	})
+	return subscriptions, err
+}
+
+// webhookTitles reads the titles of a batch from g, the counts of removed titles are gone
+func (g *generation) webhookTitles(libraryIdInt uint16, event string, mediaIds []uint32) ([]WebhookTitle, error) {
+	titles := make([]WebhookTitle, 0, len(mediaIds))
+	err := db.View(func(txn *badger.Txn) error {
+		for _, mediaId := range mediaIds {
+			title := WebhookTitle{MediaId: mediaId}
+			if media, err := g.getMediaTxn(txn, mediaId); err == nil {
+				title.Title = media.Title
+			}
+			if event != webhookEventRemoved {
+				counts, err := g.getLibraryMediaCounts(txn, libraryIdInt, mediaId)
+				if err != nil {
+					return err
+				}
+				results := g.NewMediaCountResults(counts)
+				title.MediaCountResults = &results
+			}
+			titles = append(titles, title)
+		}
+		return nil
+	})
+	return titles, err
+}
+
+// webhookMutex keeps the deliveries of consecutive loads from interleaving
+var webhookMutex sync.Mutex
+
+// deliverChangeWebhooks sends the change set of g to every subscription, one
+// payload per library, event and batch of titles. the caller holds a reference
+// to g, it's released once every subscription is done. subscriptions are
+// delivered to concurrently so a failing endpoint only delays its own deliveries
+func deliverChangeWebhooks(g *generation) {
+	defer g.release()
+	if g.changes == nil {
+		return
+	}
+	subscriptions, err := readWebhookSubscriptions()
+	if err != nil {
+		log.Error().Err(err).Uint32("generation", g.id).Msg("failed to read webhook subscriptions")
+		return
+	}
+	if len(subscriptions) == 0 {
+		return
+	}
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+	start := time.Now()
+	client := &http.Client{Timeout: notifierTimeout}
+	deliveries := make([]int, len(subscriptions))
+	var wg sync.WaitGroup
+	for i, subscription := range subscriptions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deliveries[i] = g.deliverSubscriptionChanges(client, subscription)
+		}()
+	}
+	wg.Wait()
+	total := 0
+	for _, count := range deliveries {
+		total += count
+	}
+	log.Info().Uint32("generation", g.id).Int("subscriptions", len(subscriptions)).Int("deliveries", total).
+		Dur("duration", time.Since(start)).
+		Msg("delivered change webhooks")
+}
+
+// deliverSubscriptionChanges sends the changes a subscription wants, reading
+// one batch of titles at a time so only that batch is in memory. once a
+// delivery fails after its retries the rest of the load is skipped for the
+// subscription. it returns how many deliveries were made
+func (g *generation) deliverSubscriptionChanges(client *http.Client, subscription *WebhookSubscription) int {
+	delivered := 0
+	batch := make([]uint32, webhookBatchSize)
+	for libraryIdInt, changes := range g.changes.Libraries {
+		library, visible := g.library(libraryIdInt)
+		if !visible {
+			continue
+		}
+		for _, event := range webhookEvents {
+			if !subscription.wants(event, library.Id) {
+				continue
+			}
+			var bitmap *roaring.Bitmap
+			switch event {
+			case webhookEventAdded:
+				bitmap = changes.Added
+			case webhookEventRemoved:
+				bitmap = changes.Removed
+			default:
+				bitmap = changes.Changed
+			}
+			iter := bitmap.ManyIterator()
+			for n := iter.NextMany(batch); n > 0; n = iter.NextMany(batch) {
+				titles, err := g.webhookTitles(libraryIdInt, event, batch[:n])
+				if err != nil {
+					log.Error().Err(err).Str("subscription", subscription.Id).Str("libraryId", library.Id).
+						Msg("failed to read webhook titles, skipping the rest of the load")
+					return delivered
+				}
+				delivered++
+				err = deliverWebhook(client, subscription, WebhookPayload{
+					Event:     event,
+					LibraryId: library.Id,
+					Snapshot:  g.changes.Snapshot,
+					Titles:    titles,
+				})
+				if err != nil {
+					log.Warn().Str("subscription", subscription.Id).Uint32("generation", g.id).
+						Msg("skipping the rest of the load for a failing webhook")
+					return delivered
+				}
+			}
+		}
+	}
+	return delivered
+}
+
+// deliverWebhook posts a signed payload, retrying with backoff on network
+// errors, 429 and 5xx, and records the outcome in the delivery log. it returns
+// the error of a delivery that failed for good
+func deliverWebhook(client *http.Client, subscription *WebhookSubscription, payload WebhookPayload) error {
+	delivery := WebhookDelivery{
+		Event:     payload.Event,
+		LibraryId: payload.LibraryId,
+		Snapshot:  payload.Snapshot,
+		Titles:    len(payload.Titles),
+		Created:   time.Now().UTC(),
+	}
+	var err error
+	delivery.DeliveryId, err = randomHex(16)
+	if err == nil {
+		payload.DeliveryId = delivery.DeliveryId
+		payload.Sent = delivery.Created
+		var body []byte
+		body, err = json.Marshal(payload)
+		if err == nil {
+			err = postWebhook(client, subscription, body, &delivery)
+		}
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+		log.Error().Err(err).Str("subscription", subscription.Id).Str("event", payload.Event).
+			Str("libraryId", payload.LibraryId).Int("attempts", delivery.Attempts).
+			Msg("failed to deliver webhook")
+	}
+	delivery.Success = err == nil
+	buf, logErr := json.Marshal(delivery)
+	if logErr == nil {
+		logErr = db.Update(func(txn *badger.Txn) error {
+			return txn.Set(getWebhookDeliveryKey(subscription.Id, delivery.Created), buf)
+		})
+	}
+	if logErr != nil {
+		log.Error().Err(logErr).Str("subscription", subscription.Id).Msg("failed to log webhook delivery")
+	}
+	return err
+}
+
+func postWebhook(client *http.Client, subscription *WebhookSubscription, body []byte, delivery *WebhookDelivery) error {
+	backoff := webhookBackoff
+	var err error
+	for delivery.Attempts < webhookMaxAttempts {
+		if delivery.Attempts > 0 {
+			// jitter keeps retries of many subscriptions from lining up
+			time.Sleep(backoff + time.Duration(mathrand.Int63n(int64(backoff/2))))
+			backoff *= 2
+		}
+		delivery.Attempts++
+		var retry bool
+		retry, err = postWebhookOnce(client, subscription, body, delivery)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// postWebhookOnce makes one attempt, it reports whether a failure is worth retrying
+func postWebhookOnce(client *http.Client, subscription *WebhookSubscription, body []byte, delivery *WebhookDelivery) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifierTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.Url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Deeplibby-Delivery", delivery.DeliveryId)
+	req.Header.Set("X-Deeplibby-Event", delivery.Event)
+	req.Header.Set("X-Deeplibby-Signature", signWebhookPayload(subscription.Secret, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook returned %s", resp.Status)
+}
+
+func webhookSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	subscriptions, err := readWebhookSubscriptions()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read webhook subscriptions")
+		http.Error(w, "failed to read webhook subscriptions", http.StatusInternalServerError)
+		return
+	}
+	for _, subscription := range subscriptions {
+		subscription.Secret = ""
+	}
+	if subscriptions == nil {
+		subscriptions = []*WebhookSubscription{}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(subscriptions)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode webhook subscriptions")
+	}
+}
+
+func createWebhookSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	g := requestGeneration(r)
+	var request WebhookSubscriptionRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "invalid webhook subscription: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := request.validate(g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	subscription := &WebhookSubscription{
+		Url:        request.Url,
+		LibraryIds: request.LibraryIds,
+		Events:     request.Events,
+		Secret:     request.Secret,
+		Created:    time.Now().UTC(),
+	}
+	var err error
+	subscription.Id, err = randomHex(16)
+	if err == nil && subscription.Secret == "" {
+		subscription.Secret, err = randomHex(32)
+	}
+	var buf []byte
+	if err == nil {
+		buf, err = json.Marshal(subscription)
+	}
+	if err == nil {
+		err = db.Update(func(txn *badger.Txn) error {
+			return txn.Set(getWebhookKey(subscription.Id), buf)
+		})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to save webhook subscription")
+		http.Error(w, "failed to save webhook subscription", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("subscription", subscription.Id).Str("url", subscription.Url).Msg("created webhook subscription")
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(subscription)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode webhook subscription")
+	}
+}
+
+func deleteWebhookSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	subscriptionId := r.URL.Query().Get("id")
+	err := db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(getWebhookKey(subscriptionId))
+		return err
+	})
+	if subscriptionId == "" || errors.Is(err, badger.ErrKeyNotFound) {
+		http.Error(w, "webhook subscription not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = deleteKeysWithPrefix(getWebhookKey(subscriptionId), getWebhookDeliveryPrefix(subscriptionId))
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to delete webhook subscription")
+		http.Error(w, "failed to delete webhook subscription", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Str("subscription", subscriptionId).Msg("deleted webhook subscription")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// webhookDeliveriesHandler lists the delivery log of a subscription, newest first
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	subscriptionId := r.URL.Query().Get("id")
+	limit := defaultDeliveryLimit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	deliveries := []WebhookDelivery{}
+	err := db.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get(getWebhookKey(subscriptionId)); err != nil {
+			return err
+		}
+		prefix := getWebhookDeliveryPrefix(subscriptionId)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.Reverse = true
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Seek(append(append([]byte{}, prefix...), 0xff)); iter.Valid() && len(deliveries) < limit; iter.Next() {
+			var delivery WebhookDelivery
+			err := iter.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &delivery)
+			})
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	if subscriptionId == "" || errors.Is(err, badger.ErrKeyNotFound) {
+		http.Error(w, "webhook subscription not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read webhook deliveries")
+		http.Error(w, "failed to read webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(WebhookDeliveriesResponse{
+		SubscriptionId: subscriptionId,
+		Deliveries:     deliveries,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode webhook deliveries")
+	}
+}